@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net"
+	"strings"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/gin-gonic/gin"
+)
+
+// ACMERegister creates an acme-dns compatible account for the user's domain or one of its subdomains
+func ACMERegister(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	var request struct {
+		Name      string   `json:"name"`
+		AllowFrom []string `json:"allowfrom"`
+	}
+	// The body is optional
+	c.ShouldBindJSON(&request)
+	name, err := models.ToASCII(strings.TrimPrefix(strings.TrimSuffix(request.Name, "."), "*."))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if name == "" {
+		name = owner.Domain
+	}
+	if name != owner.Domain && !strings.HasSuffix(name, "."+owner.Domain) {
+		c.JSON(400, gin.H{"error": "Name is not within " + owner.Domain})
+		return
+	}
+	for _, cidr := range request.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			c.JSON(400, gin.H{"error": "invalid_allowfrom_cidr"})
+			return
+		}
+	}
+	account, err := storage.DB.NewACMEAccount(owner.Username, name, request.AllowFrom)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	allowFrom := request.AllowFrom
+	if allowFrom == nil {
+		allowFrom = make([]string, 0)
+	}
+	c.JSON(201, gin.H{
+		"username":   account.Username,
+		"password":   account.Password,
+		"fulldomain": "_acme-challenge." + name,
+		"subdomain":  account.Subdomain,
+		"allowfrom":  allowFrom,
+	})
+}
+
+// ACMEUpdate sets the DNS-01 challenge of an account, authenticated by the X-Api-User and X-Api-Key headers
+func ACMEUpdate(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+
+	account, err := storage.DB.ACMELogin(c.GetHeader("X-Api-User"), c.GetHeader("X-Api-Key"))
+	if err != nil {
+		c.JSON(401, gin.H{"error": "forbidden"})
+		return
+	}
+	if account.AllowFrom != "" && !allowedFrom(account.AllowFrom, c.ClientIP()) {
+		c.JSON(401, gin.H{"error": "forbidden"})
+		return
+	}
+	var request struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "malformed_json_payload"})
+		return
+	}
+	if request.Subdomain != account.Subdomain {
+		c.JSON(401, gin.H{"error": "forbidden"})
+		return
+	}
+	// Challenge tokens are base64url encoded SHA-256 digests
+	if len(request.TXT) != 43 {
+		c.JSON(400, gin.H{"error": "bad_txt"})
+		return
+	}
+	if err := storage.DB.SetACMEChallenge(account.Subdomain, request.TXT); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"txt": request.TXT})
+}
+
+func ACMEAccounts(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	if c.Request.Method == "DELETE" {
+		var account models.ACMEAccount
+		if err := c.BindJSON(&account); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if err := storage.DB.DeleteACMEAccount(owner.Username, account.Username); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"success": "ACME account removed"})
+		return
+	}
+	accounts, err := storage.DB.GetACMEAccounts(owner.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, accounts)
+}
+
+func allowedFrom(allowFrom, clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range strings.Split(allowFrom, ",") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/dnsserver"
+	"github.com/acheong08/nameserver/models"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+// DebugResolve runs a query through the DNS handler and explains how the answer was found.
+// Answers do not depend on the client, so there is no parameter for its address.
+func DebugResolve(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	name, err := models.ToASCII(strings.TrimSuffix(c.Query("name"), "."))
+	if err != nil || name == "" {
+		c.JSON(400, gin.H{"error": "Invalid name"})
+		return
+	}
+	if name != owner.Domain && !strings.HasSuffix(name, "."+owner.Domain) {
+		c.JSON(403, gin.H{"error": "Name is not within " + owner.Domain})
+		return
+	}
+	qType, ok := dns.StringToType[strings.ToUpper(c.DefaultQuery("type", "A"))]
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid type"})
+		return
+	}
+	trace := database.NewTrace()
+	trace.Add("Query %s %s", name, dns.TypeToString[qType])
+	// There are no views or wildcards, every client gets the same answer
+	trace.Add("No view or wildcard applies")
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qType)
+	reply := dnsserver.Answer(storage, query, trace)
+
+	section := func(rrs []dns.RR) []string {
+		list := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			list = append(list, rr.String())
+		}
+		return list
+	}
+	c.JSON(200, gin.H{
+		"rcode":         dns.RcodeToString[reply.Rcode],
+		"authoritative": reply.Authoritative,
+		"answer":        section(reply.Answer),
+		"authority":     section(reply.Ns),
+		"additional":    section(reply.Extra),
+		"trace":         trace,
+	})
+}
@@ -2,18 +2,25 @@ package api
 
 import (
 	"crypto/rand"
+	"database/sql"
+	"errors"
 	"strconv"
-	"strings"
 
 	"github.com/acheong08/nameserver/caddy"
 	"github.com/acheong08/nameserver/database"
 	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/outbox"
+	"github.com/acheong08/nameserver/reconciler"
+	"github.com/acheong08/nameserver/verifier"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 var Secret [32]byte
 
+// Admins are the usernames allowed to manage shared resources such as reverse zone allocations
+var Admins []string
+
 func init() {
 	rand.Read(Secret[:])
 }
@@ -56,6 +63,25 @@ func AuthMiddleware(c *gin.Context) {
 	c.Next()
 }
 
+// AdminMiddleware only lets users listed in Admins through, it runs after AuthMiddleware
+func AdminMiddleware(c *gin.Context) {
+	if !isAdmin(c.MustGet("user").(models.User)) {
+		c.JSON(403, gin.H{"error": "Admin access required"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func isAdmin(user models.User) bool {
+	for _, admin := range Admins {
+		if user.Username == admin {
+			return true
+		}
+	}
+	return false
+}
+
 func Login(c *gin.Context) {
 	// Get username and password from form
 	var username, password string = c.PostForm("username"), c.PostForm("password")
@@ -104,17 +130,25 @@ func ServiceEntry(c *gin.Context) {
 				c.JSON(500, gin.H{"error": err.Error()})
 				return
 			}
+			statuses, err := storage.DB.SyncStatus(owner.Username)
+			if err != nil {
+				c.JSON(500, gin.H{"error": err.Error()})
+				return
+			}
 			for i := range services {
 				if services[i].Subdomain == "" {
 					services[i].Subdomain = owner.Domain
 				}
+				services[i].SyncStatus = statuses[services[i].ID]
+				services[i].Display()
 			}
 			c.JSON(200, services)
 			return
 		}
 		if subdomain == "<makenew>" {
 			c.JSON(200, models.ServiceEntry{
-				Domain: owner.Domain,
+				Domain: models.ToUnicode(owner.Domain),
+				WAF:    models.WAFSettings{Mode: models.WAFBlock, ParanoiaLevel: 1},
 			})
 			return
 		}
@@ -130,6 +164,10 @@ func ServiceEntry(c *gin.Context) {
 			return
 		}
 		service.Domain = owner.Domain
+		if statuses, err := storage.DB.SyncStatus(owner.Username); err == nil {
+			service.SyncStatus = statuses[service.ID]
+		}
+		service.Display()
 		c.JSON(200, service)
 		return
 	}
@@ -141,61 +179,121 @@ func ServiceEntry(c *gin.Context) {
 
 	// Prevent users from adding service entries for other users
 	config.Owner = owner.Username
-	config.Subdomain = strings.ToLower(config.Subdomain)
+	config.Domain = owner.Domain
+	// Unicode names are stored as punycode to match queries and Caddy hosts
+	if errs := config.Normalize(); len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Invalid service entry", "fields": errs})
+		return
+	}
+	// The stored entry is needed to flush its old answers and route
+	var previous models.ServiceEntry
+	if c.Request.Method == "PATCH" || c.Request.Method == "DELETE" {
+		var err error
+		previous, err = storage.DB.GetService(owner.Username, config.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(404, gin.H{"error": "Service entry not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if c.Request.Method == "PATCH" {
+		// The name identifies a service and its Caddy route, a different name is a new service
+		if config.Subdomain != "" && config.Subdomain != previous.Subdomain {
+			c.JSON(400, gin.H{"error": "Invalid service entry", "fields": []models.FieldError{{Field: "subdomain", Message: "Subdomain cannot be changed, add a new service instead"}}})
+			return
+		}
+		config.Subdomain = previous.Subdomain
+	}
+	if c.Request.Method == "DELETE" {
+		// Deletes only need the ID, the stored entry decides what is flushed
+		config = previous
+		config.Domain = owner.Domain
+	}
+	if c.Request.Method == "POST" || c.Request.Method == "PATCH" {
+		if errs := config.Validate(); len(errs) > 0 {
+			c.JSON(400, gin.H{"error": "Invalid service entry", "fields": errs})
+			return
+		}
+	}
 	var message string
+	// Warnings do not block the change but are shown to the user
+	warnings := lintChange(storage, owner, config, c.Request.Method)
+	// Caddy is updated by the outbox worker once the change is committed
+	queued := false
 
 	switch c.Request.Method {
 	case "POST":
-		if !config.IsValidFOrPost() {
-			c.JSON(400, gin.H{"error": "Invalid service entry"})
+		if config.Forwarding && !requireVerified(c, storage, owner) {
 			return
 		}
-		tx, err := storage.DB.NewService(config)
+		if config.Forwarding && !requireModules(c, config) {
+			return
+		}
+		// Older forwarded services for the same name are replaced by the new one
+		existing, _ := storage.DB.GetServicesBySubdomain(owner.Username, config.Subdomain)
+		tx, id, err := storage.DB.NewService(config)
 		if err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
 
 		if config.Forwarding {
-			// Delete old service service entry
-			// Error can be ignored since it might not exist
-			caddy.RemoveHost(config.Subdomain + "." + owner.Domain)
-			err = caddy.AddConfig(caddy.NewConfig(config.Subdomain+"."+owner.Domain, constructUpstream(config.Destination, config.Port)))
-			if err != nil {
-				tx.Rollback()
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
+			for _, service := range existing {
+				if service.Forwarding && err == nil {
+					err = outbox.QueueRemove(storage, tx, owner.Username, service.ID)
+				}
 			}
+			config.ID = id
+			if err == nil {
+				err = outbox.QueueUpdate(storage, tx, config)
+			}
+			queued = true
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
 		}
-		tx.Commit()
-		storage.Cache.Delete(config.Subdomain + "." + owner.Domain)
+		storage.Cache.Delete(hostOf(config, owner.Domain))
+		storage.FlushReverse(config.Destination)
 		message = "Service entry added"
 
 	case "DELETE":
 		// Remove service entry from storage
-		tx, err := storage.DB.DeleteService(owner.Username, config.ID)
+		tx, err := storage.DB.DeleteService(owner.Username, previous.ID)
 		if err != nil {
-			tx.Rollback()
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
-		if config.Forwarding {
-			// Update caddy
-			err = caddy.RemoveHost(config.Subdomain + "." + owner.Domain)
-
-			if err != nil {
-				tx.Rollback()
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
+		if previous.Forwarding {
+			err = outbox.QueueRemove(storage, tx, owner.Username, previous.ID)
+			queued = true
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
 		}
-		tx.Commit()
-		storage.Cache.Delete(config.Subdomain + "." + owner.Domain)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		storage.Cache.Delete(hostOf(previous, owner.Domain))
+		storage.FlushReverse(previous.Destination)
 		message = "Service entry removed"
 
 	case "PATCH":
-		if !config.IsValidFOrPost() {
-			c.JSON(400, gin.H{"error": "Invalid service entry"})
+		if config.Forwarding && !requireVerified(c, storage, owner) {
+			return
+		}
+		if config.Forwarding && !requireModules(c, config) {
 			return
 		}
 		tx, err := storage.DB.UpdateService(config)
@@ -204,18 +302,24 @@ func ServiceEntry(c *gin.Context) {
 			return
 		}
 		if config.Forwarding {
-			err = caddy.Update(caddy.NewConfig(
-				config.Subdomain+"."+owner.Domain,
-				constructUpstream(config.Destination, config.Port),
-			))
-			if err != nil {
-				tx.Rollback()
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
+			err = outbox.QueueUpdate(storage, tx, config)
+			queued = true
+		} else if previous.Forwarding {
+			err = outbox.QueueRemove(storage, tx, owner.Username, config.ID)
+			queued = true
 		}
-		tx.Commit()
-		storage.Cache.Delete(config.Subdomain + "." + owner.Domain)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		storage.Cache.Delete(hostOf(config, owner.Domain))
+		storage.FlushReverse(previous.Destination)
+		storage.FlushReverse(config.Destination)
 		message = "Service entry updated"
 
 	default:
@@ -223,8 +327,19 @@ func ServiceEntry(c *gin.Context) {
 		return
 
 	}
+	if config.DNSRecordType == "NS" || previous.DNSRecordType == "NS" {
+		// Delegations affect every cached name beneath the subdomain
+		storage.Cache.Clear()
+	}
+	// Pick up the new serial
+	storage.FlushZone(owner.Domain)
 
-	c.JSON(200, gin.H{"success": message})
+	response := gin.H{"success": message, "warnings": warnings}
+	if queued {
+		outbox.Notify()
+		response["sync_status"] = "pending"
+	}
+	c.JSON(200, response)
 	return
 }
 
@@ -234,6 +349,93 @@ func ClearCache(c *gin.Context) {
 	c.JSON(200, gin.H{"success": "Cache cleared"})
 }
 
-func constructUpstream(dest string, port int) string {
-	return dest + ":" + strconv.Itoa(port)
+// Events lists the user's events, admins also see those of other users and of the server
+func Events(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "Invalid limit"})
+		return
+	}
+	events, err := storage.DB.GetEvents(owner.Username, isAdmin(owner), c.Query("kind"), limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, events)
+}
+
+// Reconcile repairs drift between the database and Caddy immediately
+func Reconcile(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	proxy := c.MustGet("caddy").(*caddy.Client)
+	report, err := reconciler.Reconcile(storage, proxy)
+	if err != nil {
+		c.JSON(502, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"drifted": report.Drifted(), "report": report})
+}
+
+// Verification shows how to verify the user's domain. POST checks it immediately.
+func Verification(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	user, err := storage.DB.GetUser(owner.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Request.Method == "POST" && !user.Verified {
+		user.Verified, err = verifier.Verify(storage, user)
+		if err != nil {
+			c.JSON(502, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(200, gin.H{
+		"domain":      user.Domain,
+		"verified":    user.Verified,
+		"txt_name":    verifier.RecordName(user.Domain),
+		"txt_value":   user.VerificationToken,
+		"nameservers": storage.Nameservers,
+	})
+}
+
+// requireVerified rejects changes to Caddy for domains that are not verified yet
+func requireVerified(c *gin.Context, storage *database.Storage, owner models.User) bool {
+	user, err := storage.DB.GetUser(owner.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return false
+	}
+	if !user.Verified {
+		c.JSON(403, gin.H{"error": "Domain " + user.Domain + " is not verified"})
+		return false
+	}
+	return true
+}
+
+// requireModules rejects features the running Caddy lacks the modules for.
+// The change is accepted if Caddy cannot be reached, the sync status shows any failure later.
+func requireModules(c *gin.Context, config models.ServiceEntry) bool {
+	proxy := c.MustGet("caddy").(*caddy.Client)
+	errs := make([]models.FieldError, 0)
+	if config.RateLimit > 0 {
+		if ok, err := proxy.HasRateLimit(); err == nil && !ok {
+			errs = append(errs, models.FieldError{Field: "rate_limit", Message: "Caddy is missing the rate_limit module (github.com/mholt/caddy-ratelimit)"})
+		}
+	}
+	if config.WAF.Enabled {
+		if ok, err := proxy.HasWAF(); err == nil && !ok {
+			errs = append(errs, models.FieldError{Field: "waf", Message: "Caddy is missing the coraza_waf module (github.com/corazawaf/coraza-caddy/v2)"})
+		}
+	}
+	if len(errs) > 0 {
+		c.JSON(400, gin.H{"error": "Invalid service entry", "fields": errs})
+		return false
+	}
+	return true
 }
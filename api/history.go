@@ -0,0 +1,103 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/outbox"
+	"github.com/gin-gonic/gin"
+)
+
+func History(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "Invalid limit"})
+		return
+	}
+	changes, err := storage.DB.GetHistory(owner.Username, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, changes)
+}
+
+// HistoryDiff compares two versions of the zone. ?to= defaults to the latest version.
+func HistoryDiff(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid from version"})
+		return
+	}
+	to, err := strconv.Atoi(c.DefaultQuery("to", "0"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid to version"})
+		return
+	}
+	changes, err := storage.DB.DiffVersions(owner.Username, from, to)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, changes)
+}
+
+// Rollback restores the zone to a version and queues the Caddy routes of forwarded services
+func Rollback(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	var request struct {
+		Version int `json:"version"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Version <= 0 {
+		c.JSON(400, gin.H{"error": "Version required"})
+		return
+	}
+	tx, changes, err := storage.DB.Rollback(owner.Username, owner.Username, request.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(404, gin.H{"error": "Version not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for _, change := range changes {
+		if change.After != nil && change.After.Forwarded() {
+			service := *change.After
+			service.ID = change.ServiceID
+			service.Owner = owner.Username
+			service.Domain = owner.Domain
+			err = outbox.QueueUpdate(storage, tx, service)
+		} else if change.Before != nil && change.Before.Forwarded() {
+			err = outbox.QueueRemove(storage, tx, owner.Username, change.ServiceID)
+		}
+		if err != nil {
+			tx.Rollback()
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	outbox.Notify()
+	storage.Cache.Clear()
+	storage.FlushZone(owner.Domain)
+	c.JSON(200, gin.H{"success": "Zone rolled back", "changes": changes})
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/gin-gonic/gin"
+)
+
+func ReverseZone(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	if c.Request.Method == "GET" {
+		zones, err := storage.DB.GetReverseZones(owner.Username)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, zones)
+		return
+	}
+	var zone models.ReverseZone
+	if err := c.BindJSON(&zone); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	zone.Owner = owner.Username
+	var message string
+
+	switch c.Request.Method {
+	case "POST":
+		_, prefix, err := net.ParseCIDR(zone.Prefix)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid prefix"})
+			return
+		}
+		zone.Prefix = prefix.String()
+		overlap, err := storage.DB.OverlappingReverseZone(owner.Username, prefix)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if overlap != nil {
+			c.JSON(409, gin.H{"error": "Prefix overlaps " + overlap.Prefix + " of another user"})
+			return
+		}
+		// Anyone could claim any prefix, so allocations wait for an admin
+		zone.Approved = isAdmin(owner)
+		if err := storage.DB.NewReverseZone(zone); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		message = "Reverse zone added"
+		if !zone.Approved {
+			message = "Reverse zone added, it is served once an admin approves it"
+		}
+	case "DELETE":
+		if err := storage.DB.DeleteReverseZone(owner.Username, zone.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(404, gin.H{"error": "Reverse zone not found"})
+				return
+			}
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		message = "Reverse zone removed"
+	default:
+		c.JSON(405, gin.H{"error": "Method not allowed"})
+		return
+	}
+	// PTR answers may come from any zone so flush everything
+	storage.Cache.Clear()
+	c.JSON(200, gin.H{"success": message})
+}
+
+// ApproveReverseZone lists every reverse zone on GET, approves one on POST and rejects one on DELETE
+func ApproveReverseZone(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+
+	if c.Request.Method == "GET" {
+		zones, err := storage.DB.GetAllReverseZones()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, zones)
+		return
+	}
+	var request struct {
+		ID int `json:"id"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	zone, err := storage.DB.GetReverseZone(request.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Reverse zone not found"})
+		return
+	}
+	if c.Request.Method == "DELETE" {
+		if err := storage.DB.DeleteReverseZone(zone.Owner, zone.ID); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		storage.Cache.Clear()
+		c.JSON(200, gin.H{"success": "Reverse zone rejected"})
+		return
+	}
+	// Another owner's zone may have been approved since this one was requested
+	_, prefix, err := net.ParseCIDR(zone.Prefix)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	overlap, err := storage.DB.OverlappingReverseZone(zone.Owner, prefix)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if overlap != nil {
+		c.JSON(409, gin.H{"error": "Prefix overlaps " + overlap.Prefix + " of " + overlap.Owner})
+		return
+	}
+	if err := storage.DB.ApproveReverseZone(zone.ID); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	storage.Cache.Clear()
+	c.JSON(200, gin.H{"success": "Reverse zone approved"})
+}
+
+func PTRRecord(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	if c.Request.Method == "GET" {
+		zoneID, err := strconv.Atoi(c.Query("zone"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid zone ID"})
+			return
+		}
+		records, err := storage.DB.GetPTRRecords(owner.Username, zoneID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, records)
+		return
+	}
+	var record models.PTRRecord
+	if err := c.BindJSON(&record); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	var message string
+
+	switch c.Request.Method {
+	case "POST":
+		if record.Hostname == "" {
+			c.JSON(400, gin.H{"error": "Hostname required"})
+			return
+		}
+		if err := storage.DB.NewPTRRecord(owner.Username, record); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		message = "PTR record added"
+	case "DELETE":
+		existing, err := storage.DB.GetPTRRecord(owner.Username, record.ID)
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		if err := storage.DB.DeletePTRRecord(owner.Username, record.ID); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		record = existing
+		message = "PTR record removed"
+	default:
+		c.JSON(405, gin.H{"error": "Method not allowed"})
+		return
+	}
+	storage.FlushReverse(record.Address)
+	c.JSON(200, gin.H{"success": message})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/waflog"
+	"github.com/gin-gonic/gin"
+)
+
+// WAFLog is the path of Caddy's JSON log holding the firewall matches
+var WAFLog string
+
+// WAFHits lists the most recent firewall matches for the user's domain, or one service with ?service=
+func WAFHits(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	if WAFLog == "" {
+		c.JSON(404, gin.H{"error": "WAF log is not configured"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{"error": "Invalid limit"})
+		return
+	}
+	// Only hits for the hosts of the user's own forwarded services are shown.
+	// Matching by domain suffix would leak the hits of another user holding a subdomain.
+	services, err := storage.DB.GetAllServices(owner.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	hosts := make(map[string]bool)
+	for _, service := range services {
+		if service.Forwarding {
+			hosts[hostOf(service, owner.Domain)] = true
+		}
+	}
+	allow := func(host string) bool {
+		return hosts[host]
+	}
+	if id := c.Query("service"); id != "" {
+		serviceID, err := strconv.Atoi(id)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid service ID"})
+			return
+		}
+		service, err := storage.DB.GetService(owner.Username, serviceID)
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		name := hostOf(service, owner.Domain)
+		allow = func(host string) bool {
+			return host == name
+		}
+	}
+	hits, err := waflog.Recent(WAFLog, allow, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, hits)
+}
+
+// hostOf returns the name a service of domain is served at
+func hostOf(service models.ServiceEntry, domain string) string {
+	if service.Subdomain == "" {
+		return strings.ToLower(domain)
+	}
+	return strings.ToLower(service.Subdomain + "." + domain)
+}
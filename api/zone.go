@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/cfimport"
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/lint"
+	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/zonefile"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+)
+
+// ImportZone diffs a BIND zone file in the request body against the user's records.
+// The changes are only applied when ?apply=true is given.
+func ImportZone(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	records, skipped, err := zonefile.Parse(c.Request.Body, owner.Domain)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	diff, err := storage.DiffZone(owner.Username, records)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	diff.Skipped = append(skipped, diff.Skipped...)
+	if c.Query("apply") != "true" {
+		c.JSON(200, diff)
+		return
+	}
+	if err := storage.ApplyZoneDiff(owner.Username, diff); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	storage.FlushZone(owner.Domain)
+	c.JSON(200, diff)
+}
+
+func ExportZone(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	zone, err := zonefile.FromStorage(storage, owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var buf bytes.Buffer
+	if err := zonefile.Render(&buf, zone); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\""+owner.Domain+".zone\"")
+	c.Data(200, "text/dns", buf.Bytes())
+}
+
+// ImportCloudflare previews or applies a Cloudflare export.
+// ?format=bind accepts a BIND export, otherwise the JSON records listing is expected.
+// Proxied records are forwarded to ?port= on their origin (default 80).
+func ImportCloudflare(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	port, err := strconv.Atoi(c.DefaultQuery("port", "80"))
+	if err != nil || port <= 0 || port > 65535 {
+		c.JSON(400, gin.H{"error": "Invalid port"})
+		return
+	}
+	var records []cfimport.Record
+	if c.Query("format") == "bind" {
+		records, err = cfimport.ParseExport(c.Request.Body, owner.Domain)
+	} else {
+		records, err = cfimport.ParseJSON(c.Request.Body)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	plain, forward, skipped := cfimport.Translate(records, owner.Domain, port)
+	report, err := cfimport.Preview(storage, owner, plain, forward, skipped)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("apply") != "true" {
+		c.JSON(200, report)
+		return
+	}
+	if err := cfimport.Apply(storage, owner, report); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// LintZone reports problems in the user's zone. ?check_upstreams=true also dials forwarding upstreams.
+func LintZone(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	services, err := storage.DB.GetAllServices(owner.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	settings, err := storage.ZoneSettings(owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	opts := lint.Options{Settings: &settings}
+	if c.Query("check_upstreams") == "true" {
+		opts.DialTimeout = 3 * time.Second
+	}
+	c.JSON(200, lint.Zone(owner.Domain, services, opts))
+}
+
+// lintChange lints the zone as it would be after a service entry change
+// and returns the warnings concerning the changed name
+func lintChange(storage *database.Storage, owner models.User, config models.ServiceEntry, method string) []lint.Warning {
+	services, err := storage.DB.GetAllServices(owner.Username)
+	if err != nil {
+		return nil
+	}
+	records := make([]models.ServiceEntry, 0, len(services)+1)
+	for _, service := range services {
+		if (method == "PATCH" || method == "DELETE") && service.ID == config.ID {
+			continue
+		}
+		records = append(records, service)
+	}
+	if method == "POST" || method == "PATCH" {
+		records = append(records, config)
+	}
+	name := owner.Domain
+	if config.Subdomain != "" {
+		name = config.Subdomain + "." + owner.Domain
+	}
+	warnings := make([]lint.Warning, 0)
+	for _, warning := range lint.Zone(owner.Domain, records, lint.Options{}) {
+		if warning.Name == name {
+			warnings = append(warnings, warning)
+		}
+	}
+	if config.Forwarding && method != "DELETE" {
+		warnings = append(warnings, lint.CheckUpstreams(name, config, 3*time.Second)...)
+	}
+	return warnings
+}
+
+// ZoneSettings shows or edits the SOA and NS settings of the user's zone.
+// Zero values and empty strings restore the server defaults.
+func ZoneSettings(c *gin.Context) {
+	storage := c.MustGet("storage").(*database.Storage)
+	owner := c.MustGet("user").(models.User)
+
+	if c.Request.Method == "PATCH" {
+		var settings models.ZoneSettings
+		if err := c.BindJSON(&settings); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		errs := make([]models.FieldError, 0)
+		if settings.Hostmaster != "" && !strings.Contains(settings.Hostmaster, "@") {
+			errs = append(errs, models.FieldError{Field: "hostmaster", Message: "Hostmaster must be an email address"})
+		}
+		if settings.PrimaryNS != "" {
+			if _, ok := dns.IsDomainName(settings.PrimaryNS); !ok {
+				errs = append(errs, models.FieldError{Field: "primary_ns", Message: "Primary nameserver must be a hostname"})
+			}
+		}
+		for _, ns := range settings.Nameservers {
+			if _, ok := dns.IsDomainName(ns); !ok || ns == "" {
+				errs = append(errs, models.FieldError{Field: "nameservers", Message: ns + " is not a hostname"})
+			}
+		}
+		if settings.Retry != 0 && settings.Refresh != 0 && settings.Retry > settings.Refresh {
+			errs = append(errs, models.FieldError{Field: "retry", Message: "Retry should not be longer than refresh"})
+		}
+		if len(errs) > 0 {
+			c.JSON(400, gin.H{"error": "Invalid zone settings", "fields": errs})
+			return
+		}
+		if err := storage.DB.UpdateZoneSettings(owner.Username, settings); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		storage.FlushZone(owner.Domain)
+	}
+	settings, err := storage.ZoneSettings(owner)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, settings)
+}
@@ -4,22 +4,84 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
+
+	"github.com/acheong08/nameserver/models"
 )
 
 // Define Go structs
 type Config struct {
+	// ID is the @id of the route, used to address it directly through /id/<id>
+	ID       string   `json:"@id,omitempty"`
 	Handle   []handle `json:"handle"`
 	Match    []match  `json:"match"`
 	Terminal bool     `json:"terminal"`
 }
 
 type handle struct {
-	Handler   string      `json:"handler"`
-	Routes    []route     `json:"routes,omitempty"`
-	Upstreams []upstreamd `json:"upstreams,omitempty"`
-	Transport *transport  `json:"transport,omitempty"`
+	Handler    string               `json:"handler"`
+	Routes     []route              `json:"routes,omitempty"`
+	Upstreams  []upstreamd          `json:"upstreams,omitempty"`
+	Transport  *transport           `json:"transport,omitempty"`
+	RateLimits map[string]rateLimit `json:"rate_limits,omitempty"`
+	// Coraza WAF
+	LoadOWASPCRS bool   `json:"load_owasp_crs,omitempty"`
+	Directives   string `json:"directives,omitempty"`
+	// Load balancing of reverse_proxy
+	LoadBalancing *loadBalancing `json:"load_balancing,omitempty"`
+	HealthChecks  *healthChecks  `json:"health_checks,omitempty"`
+	// rewrite
+	StripPathPrefix string `json:"strip_path_prefix,omitempty"`
+	URI             string `json:"uri,omitempty"`
+	// static_response
+	StatusCode int                 `json:"status_code,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	// headers
+	Request  *headerOps `json:"request,omitempty"`
+	Response *headerOps `json:"response,omitempty"`
+}
+
+type headerOps struct {
+	Set    map[string][]string `json:"set,omitempty"`
+	Add    map[string][]string `json:"add,omitempty"`
+	Delete []string            `json:"delete,omitempty"`
+	// Deferred response operations run once the upstream's headers are known
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+type loadBalancing struct {
+	SelectionPolicy selectionPolicy `json:"selection_policy"`
+}
+
+type selectionPolicy struct {
+	Policy  string `json:"policy"`
+	Weights []int  `json:"weights,omitempty"`
+}
+
+type healthChecks struct {
+	Active  *activeHealthCheck  `json:"active,omitempty"`
+	Passive *passiveHealthCheck `json:"passive,omitempty"`
+}
+
+type activeHealthCheck struct {
+	URI          string `json:"uri"`
+	Interval     string `json:"interval,omitempty"`
+	ExpectStatus int    `json:"expect_status,omitempty"`
+}
+
+type passiveHealthCheck struct {
+	MaxFails     int    `json:"max_fails"`
+	FailDuration string `json:"fail_duration"`
+}
+
+// rateLimit is a zone of the rate_limit handler from github.com/mholt/caddy-ratelimit
+type rateLimit struct {
+	Key       string `json:"key"`
+	Window    string `json:"window"`
+	MaxEvents int    `json:"max_events"`
 }
 
 type transport struct {
@@ -28,36 +90,268 @@ type transport struct {
 }
 
 type route struct {
-	Handle []handle `json:"handle"`
+	Match    []match  `json:"match,omitempty"`
+	Handle   []handle `json:"handle"`
+	Terminal bool     `json:"terminal,omitempty"`
 }
 
 type match struct {
-	Host []string `json:"host"`
+	Host   []string            `json:"host,omitempty"`
+	Path   []string            `json:"path,omitempty"`
+	Method []string            `json:"method,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
 }
 
 type upstreamd struct {
 	Dial string `json:"dial"`
 }
 
-func NewConfig(host, upstream string) Config {
-	config := Config{
+// RouteID is the @id of the route of a forwarded service
+func RouteID(serviceID int) string {
+	return fmt.Sprintf("nameserver-service-%d", serviceID)
+}
+
+// ServiceConfig renders the route of a forwarded service. service.Domain must be set.
+func ServiceConfig(service models.ServiceEntry) Config {
+	host := service.Domain
+	if service.Subdomain != "" {
+		host = service.Subdomain + "." + service.Domain
+	}
+	// Handlers that run before the request reaches the upstream, in order
+	middleware := make([]handle, 0)
+	if service.RateLimit > 0 {
+		middleware = append(middleware, rateLimitHandle(service))
+	}
+	if service.WAF.Enabled {
+		middleware = append(middleware, wafHandle(service.WAF))
+	}
+	if headers, ok := headersHandle(service.Headers); ok {
+		middleware = append(middleware, headers)
+	}
+	// Requests matching no rule are proxied to the upstreams or answered by Caddy itself
+	final := reverseProxyHandle(service.Backends(), service.LoadBalancing)
+	if service.Response.Type != "" {
+		final = responseHandle(service.Response)
+	}
+	routes := []route{
+		{
+			Handle: append(middleware, final),
+		},
+	}
+	if len(service.Rules) > 0 {
+		// The middleware runs for every request, then the first matching rule or the default upstreams handle it
+		routes = make([]route, 0, len(service.Rules)+2)
+		if len(middleware) > 0 {
+			routes = append(routes, route{Handle: middleware})
+		}
+		for _, rule := range service.Rules {
+			routes = append(routes, ruleRoute(rule, service.LoadBalancing))
+		}
+		routes = append(routes, route{Handle: []handle{final}})
+	}
+	return NewConfig(service.ID, host, routes)
+}
+
+// headersHandle renders the header rules and presets of a service, ok is false when there are none
+func headersHandle(rules models.HeaderRules) (handle, bool) {
+	headers := handle{Handler: "headers"}
+	if !rules.Request.Empty() {
+		headers.Request = renderHeaderOps(rules.Request)
+	}
+	if response := rules.ResponseOps(); !response.Empty() {
+		headers.Response = renderHeaderOps(response)
+		headers.Response.Deferred = true
+	}
+	return headers, headers.Request != nil || headers.Response != nil
+}
+
+func renderHeaderOps(ops models.HeaderOps) *headerOps {
+	rendered := &headerOps{Delete: ops.Delete}
+	if len(ops.Set) > 0 {
+		rendered.Set = make(map[string][]string, len(ops.Set))
+		for name, value := range ops.Set {
+			rendered.Set[name] = []string{value}
+		}
+	}
+	if len(ops.Add) > 0 {
+		rendered.Add = make(map[string][]string, len(ops.Add))
+		for name, value := range ops.Add {
+			rendered.Add[name] = []string{value}
+		}
+	}
+	return rendered
+}
+
+// responseHandle renders a redirect or static response as a static_response handler
+func responseHandle(response models.StaticResponse) handle {
+	static := handle{
+		Handler:    "static_response",
+		StatusCode: response.StatusCode(),
+		Body:       response.Body,
+	}
+	if len(response.Headers) > 0 || response.Type == models.ResponseRedirect {
+		static.Headers = make(map[string][]string, len(response.Headers)+1)
+	}
+	for name, value := range response.Headers {
+		static.Headers[name] = []string{value}
+	}
+	if response.Type == models.ResponseRedirect {
+		location := response.Location
+		if response.PreservePath {
+			location = strings.TrimSuffix(location, "/") + "{http.request.uri}"
+		}
+		static.Headers["Location"] = []string{location}
+	}
+	return static
+}
+
+// ruleRoute renders a routing rule, which uses the selection policy and health checks of its service
+func ruleRoute(rule models.RouteRule, lb models.LoadBalancing) route {
+	matcher := match{
+		Path:   rule.Paths,
+		Method: rule.Methods,
+	}
+	if len(rule.Headers) > 0 {
+		matcher.Header = make(map[string][]string, len(rule.Headers))
+		for name, value := range rule.Headers {
+			matcher.Header[name] = []string{value}
+		}
+	}
+	handlers := make([]handle, 0, 2)
+	if rule.StripPrefix != "" || rule.Rewrite != "" {
+		handlers = append(handlers, handle{
+			Handler:         "rewrite",
+			StripPathPrefix: rule.StripPrefix,
+			URI:             rule.Rewrite,
+		})
+	}
+	// The health path belongs to the service's own upstreams, rule upstreams only get passive checks
+	lb.HealthPath = ""
+	handlers = append(handlers, reverseProxyHandle(rule.Upstreams, lb))
+	return route{
+		Match:    []match{matcher},
+		Handle:   handlers,
+		Terminal: true,
+	}
+}
+
+// reverseProxyHandle renders upstreams with their selection policy and health checks
+func reverseProxyHandle(upstreams []models.Upstream, lb models.LoadBalancing) handle {
+	proxy := handle{Handler: "reverse_proxy"}
+	weights := make([]int, 0)
+	weighted := false
+	for _, upstream := range upstreams {
+		address, _ := models.SplitScheme(upstream.Address)
+		// Caddy uses one transport for every upstream, validation makes sure they agree
+		if len(proxy.Upstreams) == 0 && models.UsesTLS(upstream.Address) {
+			proxy.Transport = &transport{
+				Protocol: "http",
+				TLS:      make(map[string]string),
+			}
+		}
+		proxy.Upstreams = append(proxy.Upstreams, upstreamd{Dial: address})
+		weight := upstream.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		weighted = weighted || weight > 1
+		weights = append(weights, weight)
+	}
+
+	if lb.Policy != "" {
+		policy := selectionPolicy{Policy: lb.Policy}
+		if lb.Policy == "round_robin" && weighted {
+			policy = selectionPolicy{Policy: "weighted_round_robin", Weights: weights}
+		}
+		proxy.LoadBalancing = &loadBalancing{SelectionPolicy: policy}
+	}
+	if lb.HealthPath != "" || lb.MaxFails > 0 {
+		proxy.HealthChecks = &healthChecks{}
+	}
+	if lb.HealthPath != "" {
+		interval := lb.HealthInterval
+		if interval == "" {
+			interval = "30s"
+		}
+		proxy.HealthChecks.Active = &activeHealthCheck{
+			URI:          lb.HealthPath,
+			Interval:     interval,
+			ExpectStatus: lb.HealthStatus,
+		}
+	}
+	if lb.MaxFails > 0 {
+		// Passive checks are disabled by Caddy without a fail duration
+		duration := lb.FailDuration
+		if duration == "" {
+			duration = "30s"
+		}
+		proxy.HealthChecks.Passive = &passiveHealthCheck{
+			MaxFails:     lb.MaxFails,
+			FailDuration: duration,
+		}
+	}
+	return proxy
+}
+
+// wafHandle renders the waf handler from github.com/corazawaf/coraza-caddy with the OWASP Core Rule Set
+func wafHandle(waf models.WAFSettings) handle {
+	engine := "On"
+	if waf.Mode == models.WAFDetect {
+		engine = "DetectionOnly"
+	}
+	directives := []string{
+		"Include @coraza.conf-recommended",
+		"Include @crs-setup.conf.example",
+		"SecRuleEngine " + engine,
+		fmt.Sprintf("SecAction \"id:900000,phase:1,pass,t:none,nolog,setvar:tx.blocking_paranoia_level=%d\"", waf.ParanoiaLevel),
+		"Include @owasp_crs/*.conf",
+	}
+	// Rules can only be removed once they are loaded
+	for _, id := range waf.Exclusions {
+		directives = append(directives, fmt.Sprintf("SecRuleRemoveById %d", id))
+	}
+	if rules := strings.TrimSpace(waf.CustomRules); rules != "" {
+		directives = append(directives, rules)
+	}
+	return handle{
+		Handler:      "waf",
+		LoadOWASPCRS: true,
+		Directives:   strings.Join(directives, "\n"),
+	}
+}
+
+func rateLimitHandle(service models.ServiceEntry) handle {
+	key := "{http.request.remote.host}"
+	if service.LimitHeader != "" {
+		key = "{http.request.header." + service.LimitHeader + "}"
+	}
+	window := "1s"
+	switch service.LimitBy {
+	case models.LimitByMinute:
+		window = "1m"
+	case models.LimitByHour:
+		window = "1h"
+	}
+	return handle{
+		Handler: "rate_limit",
+		RateLimits: map[string]rateLimit{
+			RouteID(service.ID): {
+				Key:       key,
+				Window:    window,
+				MaxEvents: service.RateLimit,
+			},
+		},
+	}
+}
+
+// NewConfig wraps the routes of a service in a subroute for its host, addressed by the service's @id
+func NewConfig(serviceID int, host string, routes []route) Config {
+	return Config{
+		ID: RouteID(serviceID),
 		Handle: []handle{
 			{
 				Handler: "subroute",
-				Routes: []route{
-					{
-						Handle: []handle{
-							{
-								Handler: "reverse_proxy",
-								Upstreams: []upstreamd{
-									{
-										Dial: upstream,
-									},
-								},
-							},
-						},
-					},
-				},
+				Routes:  routes,
 			},
 		},
 		Match: []match{
@@ -67,19 +361,6 @@ func NewConfig(host, upstream string) Config {
 		},
 		Terminal: true,
 	}
-	// Upstream must be longer than 8 characters to check for https://
-	// Check if upstream ends with 443 or starts with https://
-	if strings.HasSuffix(upstream, ":443") || strings.HasPrefix(upstream, "https://") {
-		config.Handle[0].Routes[0].Handle[0].Transport = &transport{
-			Protocol: "http",
-			TLS:      make(map[string]string),
-		}
-	}
-	if strings.HasPrefix(upstream, "https://") {
-		// This should remove https:// from upstream
-		config.Handle[0].Upstreams[0].Dial = strings.Replace(upstream, "https://", "", 1)
-	}
-	return config
 }
 
 func (c Config) JSON() []byte {
@@ -87,8 +368,8 @@ func (c Config) JSON() []byte {
 	return b
 }
 
-func ResetConfig(configs []Config) error {
-	url := "http://127.0.0.01:2019/config/apps/http/servers/srv0/routes"
+func (c *Client) ResetConfig(configs []Config) error {
+	url := c.routesURL()
 	body, _ := json.Marshal(configs)
 	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
 	if err != nil {
@@ -96,7 +377,7 @@ func ResetConfig(configs []Config) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
@@ -112,8 +393,8 @@ func ResetConfig(configs []Config) error {
 
 }
 
-func AddConfig(config Config) error {
-	url := "http://127.0.0.1:2019/config/apps/http/servers/srv0/routes"
+func (c *Client) AddConfig(config Config) error {
+	url := c.routesURL()
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(config.JSON()))
 	if err != nil {
@@ -121,7 +402,7 @@ func AddConfig(config Config) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
@@ -136,11 +417,67 @@ func AddConfig(config Config) error {
 	return nil
 }
 
-func Update(config Config) error {
-	updated := false
-	url := "http://127.0.0.1:2019/config/apps/http/servers/srv0/routes"
+// Update replaces the route of a service, adding it if Caddy does not know it yet
+func (c *Client) Update(config Config) error {
+	exists, err := c.hasID(config.ID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return c.AddConfig(config)
+	}
+	return c.request("PATCH", c.BaseURL+"/id/"+config.ID, config.JSON())
+}
+
+// Remove deletes the route of a service. Routes that do not exist are ignored.
+func (c *Client) Remove(serviceID int) error {
+	return c.RemoveID(RouteID(serviceID))
+}
+
+// RemoveID deletes a route by its @id
+func (c *Client) RemoveID(id string) error {
+	exists, err := c.hasID(id)
+	if err != nil || !exists {
+		return err
+	}
+	return c.request("DELETE", c.BaseURL+"/id/"+id, nil)
+}
+
+func (c *Client) hasID(id string) (bool, error) {
+	resp, err := c.HTTP.Get(c.BaseURL + "/id/" + id)
+	if err != nil {
+		return false, err
+	}
+	if resp == nil {
+		return false, fmt.Errorf("Caddy returned nil response")
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	// Caddy answers unknown IDs with 404 on recent versions and 400 on older ones
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == 400 && strings.Contains(string(body), "unknown object ID") {
+		return false, nil
+	}
+	return false, fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
+}
+
+func (c *Client) request(method, url string, body []byte) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewBuffer(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Get(url)
+	resp, err := c.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
@@ -148,91 +485,161 @@ func Update(config Config) error {
 		return fmt.Errorf("Caddy returned nil response")
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	var routes []Config
-	err = json.NewDecoder(resp.Body).Decode(&routes)
+// TagRoutes gives an @id to untagged routes created before routes were tagged.
+// hosts maps the host of every forwarded service to its ID.
+func (c *Client) TagRoutes(hosts map[string]int) (int, error) {
+	routes, err := c.liveRoutes()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	tagged := 0
 	for idx, route := range routes {
+		if route.ID != "" {
+			continue
+		}
 		for _, match := range route.Match {
-			for _, host := range match.Host {
-				if host == config.Match[0].Host[0] {
-					url := fmt.Sprintf("http://127.0.0.1:2019/config/apps/http/servers/srv0/routes/%d", idx)
-					req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(config.JSON()))
-					if err != nil {
-						return err
-					}
-					req.Header.Set("Content-Type", "application/json")
-
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						return err
-					}
-					if resp == nil {
-						return fmt.Errorf("Caddy returned nil response")
-					}
-					defer resp.Body.Close()
-					if resp.StatusCode != 200 {
-						return fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
-					}
-					updated = true
-				}
+			if len(match.Host) == 0 {
+				continue
+			}
+			serviceID, ok := hosts[match.Host[0]]
+			if !ok {
+				continue
+			}
+			// Only the @id is set so the rest of the route is left untouched
+			body, _ := json.Marshal(RouteID(serviceID))
+			err := c.request("PUT", fmt.Sprintf("%s/%d/@id", c.routesURL(), idx), body)
+			if err != nil {
+				return tagged, err
 			}
+			tagged++
+			break
 		}
 	}
-	if !updated {
-		return AddConfig(config)
-	}
-
-	return nil
+	return tagged, nil
 }
 
-func RemoveHost(domain string) error {
-	url := "http://127.0.0.1:2019/config/apps/http/servers/srv0/routes"
+// liveRoute is a route as listed by Caddy. Routes we did not create may hold values Config cannot,
+// e.g. durations as numbers, so only the @id and host matchers are read from every route.
+type liveRoute struct {
+	ID    string `json:"@id"`
+	Match []struct {
+		Host []string `json:"host"`
+	} `json:"match"`
+	Raw json.RawMessage `json:"-"`
+}
 
-	resp, err := http.DefaultClient.Get(url)
+// liveRoutes returns every route of our server in order
+func (c *Client) liveRoutes() ([]liveRoute, error) {
+	resp, err := c.HTTP.Get(c.routesURL())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if resp == nil {
-		return fmt.Errorf("Caddy returned nil response")
+		return nil, fmt.Errorf("Caddy returned nil response")
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
+	}
 
-	var routes []Config
-	err = json.NewDecoder(resp.Body).Decode(&routes)
+	// A server without routes is returned as null
+	var raw []json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&raw)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	routes := make([]liveRoute, 0, len(raw))
+	for _, r := range raw {
+		var route liveRoute
+		// Fields of other shapes are left empty, the route keeps its index
+		json.Unmarshal(r, &route)
+		route.Raw = r
+		routes = append(routes, route)
 	}
+	return routes, nil
+}
 
-	for idx, route := range routes {
-		for _, match := range route.Match {
-			for _, host := range match.Host {
-				if host == domain {
-					url := fmt.Sprintf("http://127.0.0.1:2019/config/apps/http/servers/srv0/routes/%d", idx)
-					req, err := http.NewRequest("DELETE", url, nil)
-					if err != nil {
-						return err
-					}
-					req.Header.Set("Content-Type", "application/json")
-
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						return err
-					}
-					if resp == nil {
-						return fmt.Errorf("Caddy returned nil response")
-					}
-					defer resp.Body.Close()
-					if resp.StatusCode != 200 {
-						return fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
-					}
-				}
+// Routes returns the live routes of forwarded services. Other routes of the server are skipped.
+func (c *Client) Routes() ([]Config, error) {
+	live, err := c.liveRoutes()
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Config, 0, len(live))
+	for _, route := range live {
+		if !Managed(route.ID) {
+			continue
+		}
+		var config Config
+		if err := json.Unmarshal(route.Raw, &config); err != nil {
+			// A route edited beyond what Config holds differs from every rendered config and is replaced
+			config = Config{ID: route.ID}
+		}
+		routes = append(routes, config)
+	}
+	return routes, nil
+}
+
+// Managed reports whether a route was created for a service
+func Managed(id string) bool {
+	return strings.HasPrefix(id, "nameserver-service-")
+}
+
+// rateLimitCheck is adapted by Caddy to find out whether the rate_limit directive is registered
+const rateLimitCheck = `:0 {
+	route {
+		rate_limit {
+			zone check {
+				key static
+				events 1
+				window 1s
 			}
 		}
 	}
+}`
 
-	return nil
+// wafCheck is adapted by Caddy to find out whether the coraza_waf directive is registered
+const wafCheck = `:0 {
+	route {
+		coraza_waf {
+			directives ` + "`SecRuleEngine On`" + `
+		}
+	}
+}`
+
+// HasRateLimit reports whether the running Caddy includes the caddy-ratelimit module
+func (c *Client) HasRateLimit() (bool, error) {
+	return c.hasDirective("rate_limit", rateLimitCheck)
+}
+
+// HasWAF reports whether the running Caddy includes the coraza-caddy module
+func (c *Client) HasWAF() (bool, error) {
+	return c.hasDirective("coraza_waf", wafCheck)
+}
+
+// hasDirective adapts a Caddyfile using the directive through the admin API, which leaves the config untouched
+func (c *Client) hasDirective(directive, caddyfile string) (bool, error) {
+	resp, err := c.HTTP.Post(c.BaseURL+"/adapt", "text/caddyfile", strings.NewReader(caddyfile))
+	if err != nil {
+		return false, err
+	}
+	if resp == nil {
+		return false, fmt.Errorf("Caddy returned nil response")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return true, nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), directive) {
+		return false, nil
+	}
+	return false, fmt.Errorf("Caddy returned status code %d", resp.StatusCode)
 }
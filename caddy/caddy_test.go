@@ -0,0 +1,137 @@
+package caddy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+func TestServiceConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		service models.ServiceEntry
+		want    string
+	}{
+		{
+			name:    "destination",
+			service: models.ServiceEntry{ID: 1, Subdomain: "www", Destination: "10.0.0.1", Port: 8080, Forwarding: true},
+			want: `{"@id":"nameserver-service-1","match":[{"host":["www.example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:8080"}]}]}
+			]}]}`,
+		},
+		{
+			name:    "apex destination on port 443",
+			service: models.ServiceEntry{ID: 2, Destination: "backend.internal", Port: 443, Forwarding: true},
+			want: `{"@id":"nameserver-service-2","match":[{"host":["example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"backend.internal:443"}],"transport":{"protocol":"http","tls":{}}}]}
+			]}]}`,
+		},
+		{
+			name:    "plain http on port 443",
+			service: models.ServiceEntry{ID: 3, Destination: "http://backend.internal", Port: 443, Forwarding: true},
+			want: `{"@id":"nameserver-service-3","match":[{"host":["example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"backend.internal:443"}]}]}
+			]}]}`,
+		},
+		{
+			name: "weighted upstreams with health checks",
+			service: models.ServiceEntry{ID: 4, Forwarding: true, LoadBalancing: models.LoadBalancing{
+				Upstreams:  []models.Upstream{{Address: "https://a.internal:8443", Weight: 3}, {Address: "https://b.internal:8443"}},
+				Policy:     "round_robin",
+				HealthPath: "/health",
+				MaxFails:   2,
+			}},
+			want: `{"@id":"nameserver-service-4","match":[{"host":["example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"reverse_proxy",
+					"upstreams":[{"dial":"a.internal:8443"},{"dial":"b.internal:8443"}],
+					"transport":{"protocol":"http","tls":{}},
+					"load_balancing":{"selection_policy":{"policy":"weighted_round_robin","weights":[3,1]}},
+					"health_checks":{"active":{"uri":"/health","interval":"30s"},"passive":{"max_fails":2,"fail_duration":"30s"}}}]}
+			]}]}`,
+		},
+		{
+			name: "rules keep passive checks only",
+			service: models.ServiceEntry{ID: 5, Subdomain: "app", Destination: "10.0.0.1", Port: 80, Forwarding: true, RateLimit: 10,
+				LoadBalancing: models.LoadBalancing{HealthPath: "/health", MaxFails: 1, FailDuration: "10s"},
+				Rules:         models.RouteRules{{Paths: []string{"/api/*"}, StripPrefix: "/api", Upstreams: []models.Upstream{{Address: "10.0.0.2:9000"}}}},
+			},
+			want: `{"@id":"nameserver-service-5","match":[{"host":["app.example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"rate_limit","rate_limits":{"nameserver-service-5":{"key":"{http.request.remote.host}","window":"1s","max_events":10}}}]},
+				{"match":[{"path":["/api/*"]}],"terminal":true,"handle":[
+					{"handler":"rewrite","strip_path_prefix":"/api"},
+					{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.2:9000"}],"health_checks":{"passive":{"max_fails":1,"fail_duration":"10s"}}}]},
+				{"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:80"}],
+					"health_checks":{"active":{"uri":"/health","interval":"30s"},"passive":{"max_fails":1,"fail_duration":"10s"}}}]}
+			]}]}`,
+		},
+		{
+			name: "redirect",
+			service: models.ServiceEntry{ID: 6, Subdomain: "old", Forwarding: true, Response: models.StaticResponse{
+				Type: models.ResponseRedirect, Location: "https://example.net/", PreservePath: true, Permanent: true,
+			}},
+			want: `{"@id":"nameserver-service-6","match":[{"host":["old.example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[{"handler":"static_response","status_code":301,"headers":{"Location":["https://example.net{http.request.uri}"]}}]}
+			]}]}`,
+		},
+		{
+			name: "static response with headers",
+			service: models.ServiceEntry{ID: 7, Forwarding: true,
+				Response: models.StaticResponse{Type: models.ResponseStatic, Body: "ok", Headers: map[string]string{"Content-Type": "text/plain"}},
+				Headers:  models.HeaderRules{Request: models.HeaderOps{Set: map[string]string{"X-Forwarded-Host": "example.com"}}},
+			},
+			want: `{"@id":"nameserver-service-7","match":[{"host":["example.com"]}],"terminal":true,"handle":[{"handler":"subroute","routes":[
+				{"handle":[
+					{"handler":"headers","request":{"set":{"X-Forwarded-Host":["example.com"]}}},
+					{"handler":"static_response","status_code":200,"body":"ok","headers":{"Content-Type":["text/plain"]}}]}
+			]}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.service.Domain = "example.com"
+			var got, want interface{}
+			if err := json.Unmarshal(ServiceConfig(test.service).JSON(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				rendered, _ := json.Marshal(got)
+				t.Errorf("config = %s", rendered)
+			}
+		})
+	}
+}
+
+func TestWAFHandle(t *testing.T) {
+	tests := []struct {
+		name string
+		waf  models.WAFSettings
+		want string
+	}{
+		{
+			name: "block",
+			waf:  models.WAFSettings{Enabled: true, Mode: models.WAFBlock, ParanoiaLevel: 2},
+			want: "Include @coraza.conf-recommended\nInclude @crs-setup.conf.example\nSecRuleEngine On\nSecAction \"id:900000,phase:1,pass,t:none,nolog,setvar:tx.blocking_paranoia_level=2\"\nInclude @owasp_crs/*.conf",
+		},
+		{
+			name: "detect with exclusions and custom rules",
+			waf:  models.WAFSettings{Enabled: true, Mode: models.WAFDetect, ParanoiaLevel: 1, Exclusions: []int{920350}, CustomRules: "  SecRule ARGS \"@contains x\" \"id:1000,deny\"\n"},
+			want: "Include @coraza.conf-recommended\nInclude @crs-setup.conf.example\nSecRuleEngine DetectionOnly\nSecAction \"id:900000,phase:1,pass,t:none,nolog,setvar:tx.blocking_paranoia_level=1\"\nInclude @owasp_crs/*.conf\nSecRuleRemoveById 920350\nSecRule ARGS \"@contains x\" \"id:1000,deny\"",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			waf := wafHandle(test.waf)
+			if waf.Handler != "waf" || !waf.LoadOWASPCRS {
+				t.Errorf("handle = %+v", waf)
+			}
+			if waf.Directives != test.want {
+				t.Errorf("directives = %q, want %q", waf.Directives, test.want)
+			}
+		})
+	}
+}
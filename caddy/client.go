@@ -0,0 +1,96 @@
+package caddy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientConfig describes how to reach the Caddy admin API
+type ClientConfig struct {
+	// BaseURL of the admin API, e.g. http://127.0.0.1:2019 or https://proxy:2021 for remote admin
+	BaseURL string
+	// Socket is a Unix socket path used instead of TCP when set
+	Socket string
+	// CertFile and KeyFile are the client certificate for Caddy's remote admin (mTLS)
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the remote admin server certificate, the system pool is used when empty
+	CAFile string
+	// Server is the name of the HTTP server holding our routes
+	Server  string
+	Timeout time.Duration
+}
+
+// Client talks to the Caddy admin API
+type Client struct {
+	// Held while routes are changed or compared with the database
+	sync.Mutex
+	BaseURL string
+	Server  string
+	HTTP    *http.Client
+}
+
+func NewClient(config ClientConfig) (*Client, error) {
+	if config.BaseURL == "" {
+		config.BaseURL = "http://127.0.0.1:2019"
+	}
+	if config.Server == "" {
+		config.Server = "srv0"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.Socket != "" {
+		socket := config.Socket
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		// The host is ignored when dialing the socket but Caddy checks it against allowed origins
+		config.BaseURL = "http://127.0.0.1"
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" || config.CAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load Caddy client certificate: %s", err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if config.CAFile != "" {
+			ca, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("No certificates found in %s", config.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Client{
+		BaseURL: strings.TrimSuffix(config.BaseURL, "/"),
+		Server:  config.Server,
+		HTTP:    &http.Client{Transport: transport, Timeout: config.Timeout},
+	}, nil
+}
+
+// routesURL is the admin endpoint holding the routes of our server
+func (c *Client) routesURL() string {
+	return c.BaseURL + "/config/apps/http/servers/" + c.Server + "/routes"
+}
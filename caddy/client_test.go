@@ -0,0 +1,94 @@
+package caddy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+// unmanagedRoutes are shaped like routes adapted from a Caddyfile, using values Config cannot hold
+const unmanagedRoutes = `
+	{"match":[{"host":["static.example.org"]}],"handle":[{"handler":"static_response","status_code":"{http.vars.status}"}]},
+	{"match":[{"host":["legacy.example.com"]}],"handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.9:80"}]}]},
+	{"@id":"caddyfile-route","handle":[{"handler":"reverse_proxy","upstreams":[{"dial":"10.0.0.1:443"}],
+		"transport":{"protocol":"http","tls":{"insecure_skip_verify":true}},
+		"health_checks":{"active":{"uri":"/","interval":30000000000}}}]}`
+
+func newTestClient(t *testing.T, routes string) (*Client, *[]string) {
+	t.Helper()
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		lock.Unlock()
+		if r.Method == "GET" && r.URL.Path == "/config/apps/http/servers/srv0/routes" {
+			w.Write([]byte(routes))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, err := NewClient(ClientConfig{BaseURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, &requests
+}
+
+func TestRoutes(t *testing.T) {
+	managed := string(ServiceConfig(models.ServiceEntry{ID: 1, Subdomain: "www", Domain: "example.com", Destination: "10.0.0.1", Port: 80, Forwarding: true}).JSON())
+	tests := []struct {
+		name   string
+		routes string
+		ids    []string
+		// full is set for routes that are read completely
+		full []bool
+	}{
+		{"no routes", `null`, nil, nil},
+		{"unmanaged routes are skipped", `[` + unmanagedRoutes + `]`, nil, nil},
+		{"managed routes", `[` + unmanagedRoutes + `,` + managed + `]`, []string{"nameserver-service-1"}, []bool{true}},
+		{"unreadable managed route", `[{"@id":"nameserver-service-2","handle":[{"handler":"static_response","status_code":"{http.vars.status}"}]}]`, []string{"nameserver-service-2"}, []bool{false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := newTestClient(t, test.routes)
+			routes, err := client.Routes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(routes) != len(test.ids) {
+				t.Fatalf("routes = %+v, want %v", routes, test.ids)
+			}
+			for i, route := range routes {
+				if route.ID != test.ids[i] {
+					t.Errorf("id = %s, want %s", route.ID, test.ids[i])
+				}
+				if full := len(route.Handle) > 0; full != test.full[i] {
+					t.Errorf("route = %+v", route)
+				}
+			}
+			if len(routes) > 0 && test.full[0] && string(routes[0].JSON()) != managed {
+				t.Errorf("route = %s, want %s", routes[0].JSON(), managed)
+			}
+		})
+	}
+}
+
+func TestTagRoutes(t *testing.T) {
+	client, requests := newTestClient(t, `[`+unmanagedRoutes+`]`)
+	tagged, err := client.TagRoutes(map[string]int{"legacy.example.com": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged != 1 {
+		t.Errorf("tagged = %d, want 1", tagged)
+	}
+	want := `PUT /config/apps/http/servers/srv0/routes/1/@id "nameserver-service-7"`
+	if last := (*requests)[len(*requests)-1]; last != want {
+		t.Errorf("request = %s, want %s", last, want)
+	}
+}
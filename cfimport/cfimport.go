@@ -0,0 +1,220 @@
+package cfimport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/outbox"
+	"github.com/acheong08/nameserver/zonefile"
+	"github.com/miekg/dns"
+)
+
+// Record is a DNS record as listed by the Cloudflare API
+type Record struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Content  string  `json:"content"`
+	Proxied  bool    `json:"proxied"`
+	TTL      int     `json:"ttl"`
+	Priority *uint16 `json:"priority,omitempty"`
+}
+
+// Report previews an import. Proxied records become forwarded services,
+// everything else is diffed like a zone file import.
+type Report struct {
+	models.ZoneDiff
+	Forward []models.ServiceEntry `json:"forward"`
+}
+
+// ParseJSON reads the response of the Cloudflare "list DNS records" API or a bare array of records
+func ParseJSON(r io.Reader) ([]Record, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var listing struct {
+		Result []Record `json:"result"`
+	}
+	if err := json.Unmarshal(body, &listing); err == nil && listing.Result != nil {
+		return listing.Result, nil
+	}
+	records := make([]Record, 0)
+	if err := json.Unmarshal(body, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ParseExport reads a Cloudflare BIND export, where proxied records are tagged with a cf-proxied:true comment
+func ParseExport(r io.Reader, domain string) ([]Record, error) {
+	parser := dns.NewZoneParser(r, dns.Fqdn(domain), "")
+	parser.SetIncludeAllowed(false)
+	records := make([]Record, 0)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeSOA {
+			continue
+		}
+		records = append(records, Record{
+			Name:    strings.TrimSuffix(header.Name, "."),
+			Type:    dns.TypeToString[header.Rrtype],
+			Content: zonefile.Rdata(rr),
+			Proxied: strings.Contains(parser.Comment(), "cf-proxied:true"),
+			TTL:     int(header.Ttl),
+		})
+	}
+	return records, parser.Err()
+}
+
+// Translate maps Cloudflare records onto service entries.
+// Proxied records are forwarded to port on their origin through Caddy.
+func Translate(records []Record, domain string, port int) ([]models.ServiceEntry, []models.ServiceEntry, []string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	plain := make([]models.ServiceEntry, 0)
+	forward := make([]models.ServiceEntry, 0)
+	skipped := make([]string, 0)
+	forwarded := make(map[string]bool)
+	for _, record := range records {
+		name := strings.ToLower(strings.TrimSuffix(record.Name, "."))
+		description := fmt.Sprintf("%s %s %s", record.Name, record.Type, record.Content)
+		var subdomain string
+		switch {
+		case name == domain:
+			subdomain = ""
+		case strings.HasSuffix(name, "."+domain):
+			subdomain = strings.TrimSuffix(name, "."+domain)
+		default:
+			skipped = append(skipped, description+": outside of zone "+domain)
+			continue
+		}
+		if record.Type == "NS" && subdomain == "" {
+			// Apex NS records are replaced by this server
+			continue
+		}
+
+		if record.Proxied {
+			if record.Type != "A" && record.Type != "AAAA" && record.Type != "CNAME" {
+				skipped = append(skipped, description+": only A, AAAA and CNAME records can be proxied")
+				continue
+			}
+			if forwarded[subdomain] {
+				skipped = append(skipped, description+": only one origin per proxied name is supported")
+				continue
+			}
+			forwarded[subdomain] = true
+			forward = append(forward, models.ServiceEntry{
+				Subdomain:     subdomain,
+				DNSRecordType: record.Type,
+				Destination:   strings.TrimSuffix(record.Content, "."),
+				Port:          port,
+				Forwarding:    true,
+			})
+			continue
+		}
+
+		recordType := record.Type
+		content := record.Content
+		switch record.Type {
+		case "CNAME":
+			// Cloudflare flattens CNAME records at the apex, which is what ALIAS does here
+			if subdomain == "" {
+				recordType = "ALIAS"
+			}
+		case "TXT":
+			if !strings.HasPrefix(content, "\"") {
+				content = strconv.Quote(content)
+			}
+		case "MX", "SRV", "URI":
+			if record.Priority != nil {
+				content = fmt.Sprintf("%d %s", *record.Priority, content)
+			}
+		}
+		if _, err := dns.NewRR(fmt.Sprintf("x. 60 IN %s %s", record.Type, content)); err != nil {
+			skipped = append(skipped, description+": "+err.Error())
+			continue
+		}
+		plain = append(plain, models.ServiceEntry{
+			Subdomain:     subdomain,
+			DNSRecordType: recordType,
+			Destination:   content,
+		})
+	}
+	return plain, forward, skipped
+}
+
+// Preview diffs translated records against the user's existing services
+func Preview(storage *database.Storage, owner models.User, plain, forward []models.ServiceEntry, skipped []string) (Report, error) {
+	diff, err := storage.DiffZone(owner.Username, plain)
+	if err != nil {
+		return Report{}, err
+	}
+	diff.Skipped = append(skipped, diff.Skipped...)
+	report := Report{ZoneDiff: diff, Forward: make([]models.ServiceEntry, 0)}
+
+	existing, err := storage.DB.GetAllServices(owner.Username)
+	if err != nil {
+		return Report{}, err
+	}
+	for _, service := range forward {
+		service.Owner = owner.Username
+		service.Domain = owner.Domain
+		if message := service.Check(); message != "" {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: %s", service.Subdomain, message))
+			continue
+		}
+		duplicate := false
+		for _, current := range existing {
+			if current.Forwarding && current.Subdomain == service.Subdomain {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			report.Skipped = append(report.Skipped, fmt.Sprintf("%s: already forwarded", service.Subdomain))
+			continue
+		}
+		report.Forward = append(report.Forward, service)
+	}
+	return report, nil
+}
+
+// Apply commits the plain records and the proxied records in one transaction and queues a Caddy route for every proxied record
+func Apply(storage *database.Storage, owner models.User, report Report) error {
+	if len(report.Forward) > 0 {
+		user, err := storage.DB.GetUser(owner.Username)
+		if err != nil {
+			return err
+		}
+		if !user.Verified {
+			return fmt.Errorf("Domain %s is not verified", user.Domain)
+		}
+	}
+	tx, ids, err := storage.DB.ImportZone(owner.Username, report.ZoneDiff, report.Forward)
+	if err != nil {
+		return err
+	}
+	for i, service := range report.Forward {
+		service.ID = ids[i]
+		service.Owner = owner.Username
+		service.Domain = owner.Domain
+		if err := outbox.QueueUpdate(storage, tx, service); err != nil {
+			tx.Rollback()
+			host := owner.Domain
+			if service.Subdomain != "" {
+				host = service.Subdomain + "." + owner.Domain
+			}
+			return fmt.Errorf("Failed to forward %s: %s", host, err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	storage.Cache.Clear()
+	outbox.Notify()
+	return nil
+}
@@ -0,0 +1,120 @@
+package cfimport
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+)
+
+func TestTranslate(t *testing.T) {
+	priority := uint16(10)
+	records := []Record{
+		{Name: "example.com", Type: "CNAME", Content: "apex.example.net"},
+		{Name: "docs.example.com", Type: "CNAME", Content: "example.net"},
+		{Name: "example.com", Type: "MX", Content: "mail.example.com", Priority: &priority},
+		{Name: "example.com", Type: "TXT", Content: "v=spf1 -all"},
+		{Name: "example.com", Type: "NS", Content: "ns1.cloudflare.com"},
+		{Name: "www.example.com", Type: "A", Content: "192.0.2.1", Proxied: true},
+		{Name: "www.example.com", Type: "AAAA", Content: "2001:db8::1", Proxied: true},
+		{Name: "other.example.net", Type: "A", Content: "192.0.2.2"},
+	}
+	plain, forward, skipped := Translate(records, "example.com", 8080)
+	wantPlain := []models.ServiceEntry{
+		{Subdomain: "", DNSRecordType: "ALIAS", Destination: "apex.example.net"},
+		{Subdomain: "docs", DNSRecordType: "CNAME", Destination: "example.net"},
+		{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com"},
+		{Subdomain: "", DNSRecordType: "TXT", Destination: "\"v=spf1 -all\""},
+	}
+	if !reflect.DeepEqual(plain, wantPlain) {
+		t.Errorf("plain = %+v, want %+v", plain, wantPlain)
+	}
+	wantForward := []models.ServiceEntry{{Subdomain: "www", DNSRecordType: "A", Destination: "192.0.2.1", Port: 8080, Forwarding: true}}
+	if !reflect.DeepEqual(forward, wantForward) {
+		t.Errorf("forward = %+v, want %+v", forward, wantForward)
+	}
+	if len(skipped) != 2 {
+		t.Errorf("skipped = %v, want the second origin and the record outside of the zone", skipped)
+	}
+}
+
+func newTestStorage(t *testing.T) (*database.Storage, models.User) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := database.NewStorage([]string{"192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storage.DB.Close()
+		os.Chdir(wd)
+	})
+	user := models.User{Username: "alice", Password: "secret", Domain: "example.com"}
+	if err := storage.DB.NewUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DB.VerifyUser(user.Username); err != nil {
+		t.Fatal(err)
+	}
+	return storage, user
+}
+
+func TestApply(t *testing.T) {
+	records := []Record{
+		{Name: "example.com", Type: "CNAME", Content: "apex.example.net"},
+		{Name: "www.example.com", Type: "A", Content: "192.0.2.1", Proxied: true},
+	}
+	tests := []struct {
+		name string
+		// fail breaks queueing the Caddy route after the records were added
+		fail     bool
+		services int
+	}{
+		{"applied", false, 2},
+		{"rolled back", true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, user := newTestStorage(t)
+			plain, forward, skipped := Translate(records, user.Domain, 80)
+			report, err := Preview(storage, user, plain, forward, skipped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Add) != 1 || len(report.Forward) != 1 {
+				t.Fatalf("report = %+v", report)
+			}
+			if test.fail {
+				db, err := sql.Open("sqlite", "nameserver.db")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = db.Exec("DROP TABLE caddy_outbox")
+				db.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = Apply(storage, user, report)
+			if (err != nil) != test.fail {
+				t.Fatalf("apply error = %v", err)
+			}
+			services, err := storage.DB.GetAllServices(user.Username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(services) != test.services {
+				t.Errorf("services = %+v, want %d", services, test.services)
+			}
+		})
+	}
+}
@@ -16,7 +16,7 @@ func main() {
 		panic("Username or password missing")
 	}
 
-	store, err := database.NewStorage("127.0.0.1")
+	store, err := database.NewStorage(nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/lint"
+	"github.com/acheong08/nameserver/zonefile"
+)
+
+func main() {
+	username := flag.String("username", "", "Owner of the zone")
+	importFile := flag.String("import", "", "BIND zone file to import")
+	apply := flag.Bool("apply", false, "Apply the import instead of only showing the diff")
+	export := flag.Bool("export", false, "Print the zone as a BIND zone file")
+	lintZone := flag.Bool("lint", false, "Check the zone for problems")
+	checkUpstreams := flag.Bool("check-upstreams", false, "Also check that forwarding upstreams are reachable when linting")
+	publicIP := flag.String("public-ip", "127.0.0.1", "Public IPv4 addresses of the reverse proxy (comma separated)")
+	publicIPv6 := flag.String("public-ipv6", "", "Public IPv6 addresses of the reverse proxy (comma separated)")
+	nameservers := flag.String("nameservers", "", "Hostnames of this nameserver (comma separated, defaults to ns1/ns2 of each domain)")
+	flag.Parse()
+	if *username == "" || (*importFile == "" && !*export && !*lintZone) {
+		panic("Username and one of -import, -export or -lint required")
+	}
+
+	store, err := database.NewStorage(splitList(*publicIP), splitList(*publicIPv6))
+	if err != nil {
+		panic(err)
+	}
+	store.Nameservers = splitList(*nameservers)
+	user, err := store.DB.GetUser(*username)
+	if err != nil {
+		panic(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if *lintZone {
+		services, err := store.DB.GetAllServices(user.Username)
+		if err != nil {
+			panic(err)
+		}
+		settings, err := store.ZoneSettings(user)
+		if err != nil {
+			panic(err)
+		}
+		opts := lint.Options{Settings: &settings}
+		if *checkUpstreams {
+			opts.DialTimeout = 3 * time.Second
+		}
+		encoder.Encode(lint.Zone(user.Domain, services, opts))
+		return
+	}
+
+	if *export {
+		zone, err := zonefile.FromStorage(store, user)
+		if err != nil {
+			panic(err)
+		}
+		if err := zonefile.Render(os.Stdout, zone); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	file, err := os.Open(*importFile)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	records, skipped, err := zonefile.Parse(file, user.Domain)
+	if err != nil {
+		panic(err)
+	}
+	diff, err := store.DiffZone(user.Username, records)
+	if err != nil {
+		panic(err)
+	}
+	diff.Skipped = append(skipped, diff.Skipped...)
+	encoder.Encode(diff)
+	if *apply {
+		if err := store.ApplyZoneDiff(user.Username, diff); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// splitList splits a comma separated flag value, ignoring empty entries
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
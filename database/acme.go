@@ -0,0 +1,122 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ACMEChallengeTTL is how long an updated DNS-01 challenge is served
+const ACMEChallengeTTL = 10 * time.Minute
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewACMEAccount registers an account for name and returns it with the plain text password
+func (d *database) NewACMEAccount(owner, name string, allowFrom []string) (models.ACMEAccount, error) {
+	account := models.ACMEAccount{
+		Username:  randomToken(16),
+		Password:  randomToken(20),
+		Subdomain: randomToken(16),
+		Owner:     owner,
+		Name:      name,
+		AllowFrom: strings.Join(allowFrom, ","),
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return account, err
+	}
+	_, err = d.db.Exec("INSERT INTO acme_accounts (username, password, subdomain, owner, name, allow_from) VALUES (?, ?, ?, ?, ?, ?)", account.Username, string(hashed), account.Subdomain, account.Owner, account.Name, account.AllowFrom)
+	return account, err
+}
+
+// ACMELogin checks the credentials of an account and returns it without the password
+func (d *database) ACMELogin(username, password string) (models.ACMEAccount, error) {
+	var account models.ACMEAccount
+	err := d.db.QueryRowx("SELECT * FROM acme_accounts WHERE username = ?", username).StructScan(&account)
+	if err != nil {
+		return account, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password))
+	account.Password = ""
+	return account, err
+}
+
+func (d *database) GetACMEAccounts(owner string) ([]models.ACMEAccount, error) {
+	accounts := make([]models.ACMEAccount, 0)
+	err := d.db.Select(&accounts, "SELECT username, subdomain, owner, name, allow_from FROM acme_accounts WHERE owner = ?", owner)
+	return accounts, err
+}
+
+func (d *database) DeleteACMEAccount(owner, username string) error {
+	var subdomain string
+	err := d.db.QueryRow("SELECT subdomain FROM acme_accounts WHERE owner = ? AND username = ?", owner, username).Scan(&subdomain)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DELETE FROM acme_txt WHERE subdomain = ?", subdomain)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DELETE FROM acme_accounts WHERE username = ?", username)
+	return err
+}
+
+// SetACMEChallenge stores a challenge token for an account.
+// Like acme-dns, the two most recent tokens are kept so a wildcard and its apex can be validated together.
+func (d *database) SetACMEChallenge(subdomain, value string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO acme_txt (subdomain, value, created_at) VALUES (?, ?, ?)", subdomain, value, time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM acme_txt WHERE subdomain = ? AND id NOT IN (SELECT id FROM acme_txt WHERE subdomain = ? ORDER BY id DESC LIMIT 2)", subdomain, subdomain)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM acme_txt WHERE created_at < ?", time.Now().UTC().Add(-ACMEChallengeTTL))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getACMEChallenges returns the unexpired challenge tokens for a name
+func (d *database) getACMEChallenges(name string) ([]string, error) {
+	values := make([]string, 0)
+	err := d.db.Select(&values, `
+		SELECT acme_txt.value FROM acme_txt
+		JOIN acme_accounts ON acme_accounts.subdomain = acme_txt.subdomain
+		JOIN users ON users.username = acme_accounts.owner
+		WHERE acme_accounts.name = ? AND acme_txt.created_at >= ? AND users.verified = 1
+	`, name, time.Now().UTC().Add(-ACMEChallengeTTL))
+	return values, err
+}
+
+// getACMEChallenge answers TXT queries for _acme-challenge names.
+// Challenges change often and expire so they bypass the cache.
+func (s *Storage) getACMEChallenge(domain string) []dnsCacheItem {
+	values, err := s.DB.getACMEChallenges(strings.TrimPrefix(domain, "_acme-challenge."))
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	items := make([]dnsCacheItem, 0, len(values))
+	for _, value := range values {
+		items = append(items, dnsCacheItem{domain, strconv.Quote(value), "TXT", time.Now(), false})
+	}
+	return items
+}
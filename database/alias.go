@@ -0,0 +1,103 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// aliasEntry holds the flattened addresses of an ALIAS target for a single record type
+type aliasEntry struct {
+	Addresses []string
+	Expires   time.Time
+}
+
+type aliasCache struct {
+	lock  sync.RWMutex
+	Items map[string]aliasEntry
+}
+
+func newAliasCache() *aliasCache {
+	return &aliasCache{sync.RWMutex{}, make(map[string]aliasEntry)}
+}
+
+func aliasKey(target string, qType uint16) string {
+	return dns.TypeToString[qType] + " " + target
+}
+
+func (c *aliasCache) Get(target string, qType uint16) (aliasEntry, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.Items[aliasKey(target, qType)]
+	if !ok || time.Now().After(entry.Expires) {
+		return aliasEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *aliasCache) Set(target string, qType uint16, entry aliasEntry) {
+	c.lock.Lock()
+	c.Items[aliasKey(target, qType)] = entry
+	c.lock.Unlock()
+}
+
+func (c *aliasCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Items = make(map[string]aliasEntry)
+}
+
+// ResolveAlias flattens an ALIAS target into A or AAAA addresses using the upstream resolver.
+// Results are cached for the lowest TTL returned by the upstream.
+// The remaining TTL in seconds is returned alongside the addresses.
+func (s *Storage) ResolveAlias(target string, qType uint16) ([]string, uint32, error) {
+	if qType != dns.TypeA && qType != dns.TypeAAAA {
+		return nil, 0, fmt.Errorf("ALIAS can only be flattened to A or AAAA")
+	}
+	target = dns.Fqdn(target)
+	if entry, ok := s.aliases.Get(target, qType); ok {
+		return entry.Addresses, uint32(time.Until(entry.Expires).Seconds()), nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(target, qType)
+	m.RecursionDesired = true
+	client := new(dns.Client)
+	r, _, err := client.Exchange(m, s.Upstream)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("Upstream returned %s for %s", dns.RcodeToString[r.Rcode], target)
+	}
+
+	addresses := make([]string, 0)
+	var ttl uint32 = 0
+	for _, answer := range r.Answer {
+		var address string
+		switch rr := answer.(type) {
+		case *dns.A:
+			address = rr.A.String()
+		case *dns.AAAA:
+			address = rr.AAAA.String()
+		default:
+			// CNAME chains are followed by the upstream
+			continue
+		}
+		if ttl == 0 || answer.Header().Ttl < ttl {
+			ttl = answer.Header().Ttl
+		}
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		// Avoid hitting the upstream on every query for targets without addresses
+		ttl = 60
+	}
+	s.aliases.Set(target, qType, aliasEntry{
+		Addresses: addresses,
+		Expires:   time.Now().Add(time.Duration(ttl) * time.Second),
+	})
+	return addresses, ttl, nil
+}
@@ -10,8 +10,13 @@ type dnsCacheItem struct {
 	Dest        string
 	RecordType  string
 	LastUpdated time.Time
+	// Referral marks NS and glue records of a delegated subdomain
+	Referral bool
 }
 
+// DNSRecord is a cached answer as returned by Storage.GetDNS
+type DNSRecord = dnsCacheItem
+
 type dnsCacheList struct {
 	Items []dnsCacheItem
 }
@@ -48,11 +53,18 @@ func (c *dnsCache) Set(domain string, dest string, recordType string) {
 		c.Items[domain] = &dnsCacheList{make([]dnsCacheItem, 0)}
 	}
 	if c.Items[domain] != nil {
-		c.Items[domain].Add(dnsCacheItem{domain, dest, recordType, time.Now()})
+		c.Items[domain].Add(dnsCacheItem{domain, dest, recordType, time.Now(), false})
 	}
 	c.lock.Unlock()
 }
 
+// SetReferral caches the delegation that answers for a domain
+func (c *dnsCache) SetReferral(domain string, items []dnsCacheItem) {
+	c.lock.Lock()
+	c.Items[domain] = &dnsCacheList{items}
+	c.lock.Unlock()
+}
+
 func (c *dnsCache) SetEmpty(domain string) {
 	c.lock.Lock()
 	c.Items[domain] = &dnsCacheList{make([]dnsCacheItem, 0)}
@@ -76,8 +88,31 @@ func (c *dnsCache) Delete(domain string) {
 	c.lock.Unlock()
 }
 
+// DeleteByDest removes every cached domain that resolves to one of the given destinations
+func (c *dnsCache) DeleteByDest(dests []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for domain, list := range c.Items {
+		for _, item := range list.Items {
+			if contains(dests, item.Dest) {
+				delete(c.Items, domain)
+				break
+			}
+		}
+	}
+}
+
 func (c *dnsCache) Clear() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.Items = make(map[string]*dnsCacheList)
 }
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/acheong08/nameserver/models"
 	sqlx "github.com/acheong08/squealx"
@@ -15,7 +18,9 @@ const (
 		CREATE TABLE IF NOT EXISTS users (
 			username TEXT PRIMARY KEY,
 			password TEXT NOT NULL,
-			domain TEXT NOT NULL
+			domain TEXT NOT NULL,
+			verified INTEGER NOT NULL DEFAULT 0,
+			verification_token TEXT NOT NULL DEFAULT ''
 		)
 	`
 	createServiceTable = `
@@ -28,7 +33,83 @@ const (
 			subdomain TEXT NOT NULL,
 			forwarding INTEGER NOT NULL,
 			rate_limit INTEGER NOT NULL,
-			limit_by INTEGER NOT NULL
+			limit_by INTEGER NOT NULL,
+			limit_header TEXT NOT NULL DEFAULT '',
+			waf TEXT NOT NULL DEFAULT '',
+			load_balancing TEXT NOT NULL DEFAULT '',
+			rules TEXT NOT NULL DEFAULT '',
+			response TEXT NOT NULL DEFAULT '',
+			headers TEXT NOT NULL DEFAULT ''
+		)
+	`
+	createReverseZoneTable = `
+		CREATE TABLE IF NOT EXISTS reverse_zones (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			owner TEXT NOT NULL,
+			prefix TEXT NOT NULL UNIQUE,
+			auto_ptr INTEGER NOT NULL,
+			approved INTEGER NOT NULL DEFAULT 0
+		)
+	`
+	createPTRTable = `
+		CREATE TABLE IF NOT EXISTS ptr_records (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			zone_id INTEGER NOT NULL,
+			address TEXT NOT NULL,
+			hostname TEXT NOT NULL
+		)
+	`
+	createACMEAccountTable = `
+		CREATE TABLE IF NOT EXISTS acme_accounts (
+			username TEXT PRIMARY KEY,
+			password TEXT NOT NULL,
+			subdomain TEXT NOT NULL UNIQUE,
+			owner TEXT NOT NULL,
+			name TEXT NOT NULL,
+			allow_from TEXT NOT NULL
+		)
+	`
+	createACMETXTTable = `
+		CREATE TABLE IF NOT EXISTS acme_txt (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subdomain TEXT NOT NULL,
+			value TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)
+	`
+	createHistoryTable = `
+		CREATE TABLE IF NOT EXISTS service_history (
+			version INTEGER PRIMARY KEY AUTOINCREMENT,
+			owner TEXT NOT NULL,
+			service_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			before TEXT,
+			after TEXT,
+			actor TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)
+	`
+	createZoneSettingsTable = `
+		CREATE TABLE IF NOT EXISTS zone_settings (
+			owner TEXT PRIMARY KEY,
+			default_ttl INTEGER NOT NULL DEFAULT 0,
+			refresh INTEGER NOT NULL DEFAULT 0,
+			retry INTEGER NOT NULL DEFAULT 0,
+			expire INTEGER NOT NULL DEFAULT 0,
+			minimum INTEGER NOT NULL DEFAULT 0,
+			primary_ns TEXT NOT NULL DEFAULT '',
+			hostmaster TEXT NOT NULL DEFAULT '',
+			nameservers TEXT NOT NULL DEFAULT '',
+			serial INTEGER NOT NULL DEFAULT 0
+		)
+	`
+	createEventTable = `
+		CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME NOT NULL,
+			kind TEXT NOT NULL,
+			message TEXT NOT NULL,
+			owner TEXT NOT NULL DEFAULT ''
 		)
 	`
 )
@@ -48,14 +129,149 @@ func newDatabase() (*database, error) {
 		return nil, err
 	}
 
+	// Users created before domain verification existed are trusted
+	err = addColumn(db, "users", "verified", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "users", "verification_token", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	// A domain is served for a single verified account
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_verified_domain ON users (domain) WHERE verified = 1")
+	if err != nil {
+		log.Printf("Failed to enforce one verified account per domain, check for duplicate domains: %s\n", err.Error())
+	}
+
 	_, err = db.Exec(createServiceTable)
 	if err != nil {
 		return nil, err
 	}
 
+	err = addColumn(db, "services", "limit_header", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "services", "waf", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "services", "load_balancing", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "services", "rules", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "services", "response", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "services", "headers", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createReverseZoneTable)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse zones created before approval existed are trusted
+	err = addColumn(db, "reverse_zones", "approved", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createPTRTable)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createACMEAccountTable)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createACMETXTTable)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createHistoryTable)
+	if err != nil {
+		return nil, err
+	}
+
+	// The baseline bumps the serials kept in zone_settings
+	_, err = db.Exec(createZoneSettingsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordBaseline(db)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createEventTable)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "events", "owner", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createOutboxTable)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addColumn(db, "caddy_outbox", "owner", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createSyncTable)
+	if err != nil {
+		return nil, err
+	}
+
 	return &database{db}, nil
 }
 
+// addColumn adds a column to an existing table unless it is already there
+func addColumn(db *sqlx.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (d *database) Close() error {
 	return d.db.Close()
 }
@@ -74,12 +290,26 @@ func (d *database) NewUser(user models.User) error {
 			tx.Commit()
 		}
 	}()
+	domain, err := models.ToASCII(user.Domain)
+	if err != nil {
+		return err
+	}
+	var verified int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE domain = ? AND verified = 1", domain).Scan(&verified)
+	if err != nil {
+		return err
+	}
+	if verified > 0 {
+		err = fmt.Errorf("Domain %s is already verified by another account", domain)
+		return err
+	}
 	// Hash password using bcrypt
 	hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec("INSERT INTO users (username, password, domain) VALUES (?, ?, ?)", user.Username, string(hashed), user.Domain)
+	// The domain stays inactive until the token or our nameservers are published
+	_, err = tx.Exec("INSERT INTO users (username, password, domain, verified, verification_token) VALUES (?, ?, ?, ?, ?)", user.Username, string(hashed), domain, false, randomToken(16))
 	if err != nil {
 		return err
 	}
@@ -97,27 +327,95 @@ func (d *database) UserLogin(username, password string) error {
 
 func (d *database) GetUser(username string) (models.User, error) {
 	var user models.User
-	err := d.db.QueryRowx("SELECT username, domain FROM users WHERE username = ?", username).StructScan(&user)
+	err := d.db.QueryRowx("SELECT username, domain, verified, verification_token FROM users WHERE username = ?", username).StructScan(&user)
 	return user, err
 }
 
+func (d *database) GetUnverifiedUsers() ([]models.User, error) {
+	users := make([]models.User, 0)
+	err := d.db.Select(&users, "SELECT username, domain, verified, verification_token FROM users WHERE verified = 0")
+	return users, err
+}
+
+func (d *database) VerifyUser(username string) error {
+	_, err := d.db.Exec("UPDATE users SET verified = 1 WHERE username = ?", username)
+	return err
+}
+
+// DomainClaims counts the accounts registered for a domain
+func (d *database) DomainClaims(domain string) (int, error) {
+	var claims int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM users WHERE domain = ?", domain).Scan(&claims)
+	return claims, err
+}
+
 func (d *database) GetDomainOwner(domain string) (models.User, error) {
 	var user models.User
-	err := d.db.QueryRowx("SELECT username, domain FROM users WHERE domain = ?", domain).StructScan(&user)
+	// Unverified claims never take over a verified domain
+	err := d.db.QueryRowx("SELECT username, domain, verified, verification_token FROM users WHERE domain = ? ORDER BY verified DESC", domain).StructScan(&user)
 	return user, err
 }
 
-func (d *database) NewService(service models.ServiceEntry) (*sql.Tx, error) {
-	tx, err := d.db.Begin()
+// serviceColumns are written by every insert and update of a service.
+// Owner and subdomain identify a service and are only set on insert, a renamed service is a new one.
+var serviceColumns = []string{"destination", "port", "dns_record_type", "forwarding", "rate_limit", "limit_by", "limit_header", "waf", "load_balancing", "rules", "response", "headers"}
+
+// serviceValues returns the values of serviceColumns in order
+func serviceValues(service models.ServiceEntry) []interface{} {
+	return []interface{}{service.Destination, service.Port, service.DNSRecordType, service.Forwarded(), service.RateLimit, service.LimitBy, service.LimitHeader, service.WAF, service.LoadBalancing, service.Rules, service.Response, service.Headers}
+}
+
+// insertService inserts every column of a service, keeping its ID unless it is 0
+func insertService(tx *sqlx.Tx, service models.ServiceEntry) (sql.Result, error) {
+	columns := append([]string{"owner", "subdomain"}, serviceColumns...)
+	values := append([]interface{}{service.Owner, service.Subdomain}, serviceValues(service)...)
+	if service.ID != 0 {
+		columns = append(columns, "id")
+		values = append(values, service.ID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return tx.Exec(fmt.Sprintf("INSERT INTO services (%s) VALUES (%s)", strings.Join(columns, ", "), placeholders), values...)
+}
+
+// updateService writes every column of serviceColumns
+func updateService(tx *sqlx.Tx, service models.ServiceEntry) (sql.Result, error) {
+	assignments := strings.Join(serviceColumns, " = ?, ") + " = ?"
+	values := append(serviceValues(service), service.Owner, service.ID)
+	return tx.Exec("UPDATE services SET "+assignments+" WHERE owner = ? AND id = ?", values...)
+}
+
+// NewService inserts a service and returns the uncommitted transaction with the new service ID
+func (d *database) NewService(service models.ServiceEntry) (*sql.Tx, int, error) {
+	tx, err := d.db.Beginx()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	_, err = tx.Exec("INSERT INTO services (owner, destination, port, dns_record_type, subdomain, forwarding, rate_limit, limit_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", service.Owner, service.Destination, service.Port, service.DNSRecordType, service.Subdomain, service.Forwarding, service.RateLimit, service.LimitBy)
+	// IDs are assigned by the database
+	service.ID = 0
+	id, err := createService(tx, service)
 	if err != nil {
-		return nil, err
+		tx.Rollback()
+		return nil, 0, err
 	}
-	return tx, nil
+	return tx.Tx, id, nil
+}
+
+// createService inserts a service and records its creation in the history
+func createService(tx *sqlx.Tx, service models.ServiceEntry) (int, error) {
+	res, err := insertService(tx, service)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	after, err := serviceInTx(tx, service.Owner, int(id))
+	if err != nil {
+		return 0, err
+	}
+	return int(id), recordChange(tx, service.Owner, service.Owner, "create", nil, &after)
 }
 
 func (d *database) GetService(owner string, id int) (models.ServiceEntry, error) {
@@ -131,6 +429,19 @@ func (d *database) GetServices(owner string) ([]models.ServiceEntry, error) {
 	err := d.db.Select(&services, "SELECT id, subdomain FROM services WHERE owner = ?", owner)
 	return services, err
 }
+func (d *database) GetAllServices(owner string) ([]models.ServiceEntry, error) {
+	services := make([]models.ServiceEntry, 0)
+	err := d.db.Select(&services, "SELECT * FROM services WHERE owner = ? ORDER BY subdomain, id", owner)
+	return services, err
+}
+
+// GetForwardingServices returns the forwarded services of every user with their domain
+func (d *database) GetForwardingServices() ([]models.ServiceEntry, error) {
+	services := make([]models.ServiceEntry, 0)
+	err := d.db.Select(&services, "SELECT services.*, users.domain AS domain FROM services JOIN users ON users.username = services.owner WHERE services.forwarding = 1 ORDER BY services.id")
+	return services, err
+}
+
 func (d *database) GetServicesBySubdomain(owner, subdomain string) ([]models.ServiceEntry, error) {
 	services := make([]models.ServiceEntry, 0)
 	err := d.db.Select(&services, "SELECT * FROM services WHERE owner = ? AND subdomain = ?", owner, subdomain)
@@ -138,27 +449,67 @@ func (d *database) GetServicesBySubdomain(owner, subdomain string) ([]models.Ser
 }
 
 func (d *database) DeleteService(owner string, id int) (*sql.Tx, error) {
-	tx, err := d.db.Begin()
+	tx, err := d.db.Beginx()
 	if err != nil {
 		return nil, err
 	}
 
+	before, err := serviceInTx(tx, owner, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	_, err = tx.Exec("DELETE FROM services WHERE owner = ? AND id = ?", owner, id)
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
-	return tx, nil
+	err = recordChange(tx, owner, owner, "delete", &before, nil)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx.Tx, nil
 }
 
 func (d *database) UpdateService(service models.ServiceEntry) (*sql.Tx, error) {
-	tx, err := d.db.Begin()
+	tx, err := d.db.Beginx()
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = tx.Exec("UPDATE services SET destination = ?, port = ?, dns_record_type = ?, forwarding = ?, rate_limit = ?, limit_by = ? WHERE owner = ? AND id = ?", service.Destination, service.Port, service.DNSRecordType, service.Forwarding, service.RateLimit, service.LimitBy, service.Owner, service.ID)
+	before, err := serviceInTx(tx, service.Owner, service.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	_, err = updateService(tx, service)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	after, err := serviceInTx(tx, service.Owner, service.ID)
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
-	return tx, nil
+	err = recordChange(tx, service.Owner, service.Owner, "update", &before, &after)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx.Tx, nil
+}
+
+// NewEvent records an event concerning owner, or the whole server when owner is empty
+func (d *database) NewEvent(owner, kind, message string) error {
+	_, err := d.db.Exec("INSERT INTO events (created_at, kind, message, owner) VALUES (?, ?, ?, ?)", time.Now().UTC(), kind, message, owner)
+	return err
+}
+
+// GetEvents returns the most recent events of owner, or of everyone when all is set, optionally filtered by kind
+func (d *database) GetEvents(owner string, all bool, kind string, limit int) ([]models.Event, error) {
+	events := make([]models.Event, 0)
+	err := d.db.Select(&events, "SELECT * FROM events WHERE (? OR owner = ?) AND (? = '' OR kind = ?) ORDER BY id DESC LIMIT ?", all, owner, kind, kind, limit)
+	return events, err
 }
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"os"
+	"testing"
+
+	sqlx "github.com/acheong08/squealx"
+)
+
+// baselineSchema is the schema of databases created before any migration existed
+const baselineSchema = `
+	CREATE TABLE users (
+		username TEXT PRIMARY KEY,
+		password TEXT NOT NULL,
+		domain TEXT NOT NULL
+	);
+	CREATE TABLE services (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		dns_record_type TEXT NOT NULL,
+		subdomain TEXT NOT NULL,
+		forwarding INTEGER NOT NULL,
+		rate_limit INTEGER NOT NULL,
+		limit_by INTEGER NOT NULL
+	);
+	INSERT INTO users (username, password, domain) VALUES ('alice', 'hash', 'example.com');
+	INSERT INTO services (owner, destination, port, dns_record_type, subdomain, forwarding, rate_limit, limit_by) VALUES
+		('alice', '192.0.2.10', 0, 'A', 'mail', 0, 0, 0),
+		('alice', '10.0.0.1', 8080, 'A', 'www', 1, 0, 0);
+`
+
+func TestMigrateBaseline(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	old, err := sqlx.Open("sqlite", "nameserver.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	// Opening twice runs the migrations on the old schema and then on the migrated one
+	for i := 0; i < 2; i++ {
+		d, err := newDatabase()
+		if err != nil {
+			t.Fatalf("open %d: %s", i, err)
+		}
+		user, err := d.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.Verified {
+			t.Error("existing users must stay verified")
+		}
+		services, err := d.GetAllServices("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 2 {
+			t.Errorf("services = %+v", services)
+		}
+		history, err := d.GetHistory("alice", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 {
+			t.Errorf("history = %+v, want one baseline version per service", history)
+		}
+		settings, err := d.getZoneSettings("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settings.Serial == 0 {
+			t.Error("the baseline must bump the zone serial")
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+func (d *database) getDelegations(owner string) ([]models.ServiceEntry, error) {
+	services := make([]models.ServiceEntry, 0)
+	err := d.db.Select(&services, "SELECT * FROM services WHERE owner = ? AND dns_record_type = 'NS' AND subdomain != ''", owner)
+	return services, err
+}
+
+// getReferral finds the closest delegated subdomain at or above subdomain.
+// NS records at the apex are our own and never delegate.
+func (s *Storage) getReferral(owner models.User, rootDomain, subdomain string) []dnsCacheItem {
+	if subdomain == "" {
+		return nil
+	}
+	delegations, err := s.DB.getDelegations(owner.Username)
+	if err != nil || len(delegations) == 0 {
+		return nil
+	}
+	cut := ""
+	for _, delegation := range delegations {
+		if subdomain != delegation.Subdomain && !strings.HasSuffix(subdomain, "."+delegation.Subdomain) {
+			continue
+		}
+		if len(delegation.Subdomain) > len(cut) {
+			cut = delegation.Subdomain
+		}
+	}
+	if cut == "" {
+		return nil
+	}
+	cutName := cut + "." + rootDomain
+	items := make([]dnsCacheItem, 0)
+	glue := make([]dnsCacheItem, 0)
+	for _, delegation := range delegations {
+		if delegation.Subdomain != cut {
+			continue
+		}
+		nsHost := strings.ToLower(strings.TrimSuffix(delegation.Destination, "."))
+		items = append(items, dnsCacheItem{cutName, dns.Fqdn(nsHost), "NS", time.Now(), true})
+		// Glue is only needed for nameservers inside the delegated zone
+		if !strings.HasSuffix(nsHost, "."+cutName) {
+			continue
+		}
+		records, err := s.DB.GetServicesBySubdomain(owner.Username, nsHost[:len(nsHost)-len(rootDomain)-1])
+		if err != nil {
+			continue
+		}
+		for _, record := range records {
+			if record.DNSRecordType == "A" || record.DNSRecordType == "AAAA" {
+				glue = append(glue, dnsCacheItem{nsHost, record.Destination, record.DNSRecordType, time.Now(), true})
+			}
+		}
+	}
+	return append(items, glue...)
+}
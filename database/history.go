@@ -0,0 +1,232 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+	sqlx "github.com/acheong08/squealx"
+)
+
+type historyRow struct {
+	Version   int            `db:"version"`
+	Owner     string         `db:"owner"`
+	ServiceID int            `db:"service_id"`
+	Action    string         `db:"action"`
+	Before    sql.NullString `db:"before"`
+	After     sql.NullString `db:"after"`
+	Actor     string         `db:"actor"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+func (r historyRow) change() models.Change {
+	change := models.Change{
+		Version:   r.Version,
+		ServiceID: r.ServiceID,
+		Action:    r.Action,
+		Actor:     r.Actor,
+		CreatedAt: r.CreatedAt,
+	}
+	if r.Before.Valid {
+		change.Before = &models.ServiceEntry{}
+		json.Unmarshal([]byte(r.Before.String), change.Before)
+	}
+	if r.After.Valid {
+		change.After = &models.ServiceEntry{}
+		json.Unmarshal([]byte(r.After.String), change.After)
+	}
+	return change
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func snapshot(service *models.ServiceEntry) sql.NullString {
+	if service == nil {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(service)
+	return sql.NullString{String: string(b), Valid: true}
+}
+
+// recordChange writes a version of a service to the history of the owner's zone
+func recordChange(tx execer, owner, actor, action string, before, after *models.ServiceEntry) error {
+	serviceID := 0
+	if before != nil {
+		serviceID = before.ID
+	} else if after != nil {
+		serviceID = after.ID
+	}
+	_, err := tx.Exec("INSERT INTO service_history (owner, service_id, action, before, after, actor, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", owner, serviceID, action, snapshot(before), snapshot(after), actor, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	// Every recorded change is a new version of the zone for secondaries
+	return bumpSerial(tx, owner)
+}
+
+// recordBaseline adds a version for services created before history was kept
+func recordBaseline(db *sqlx.DB) error {
+	services := make([]models.ServiceEntry, 0)
+	err := db.Select(&services, "SELECT * FROM services WHERE id NOT IN (SELECT service_id FROM service_history)")
+	if err != nil {
+		return err
+	}
+	for i := range services {
+		if err := recordChange(db, services[i].Owner, "system", "baseline", nil, &services[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceInTx(tx *sqlx.Tx, owner string, id int) (models.ServiceEntry, error) {
+	var service models.ServiceEntry
+	err := tx.QueryRowx("SELECT * FROM services WHERE owner = ? AND id = ?", owner, id).StructScan(&service)
+	return service, err
+}
+
+// GetHistory lists the most recent changes of a zone
+func (d *database) GetHistory(owner string, limit int) ([]models.Change, error) {
+	rows := make([]historyRow, 0)
+	err := d.db.Select(&rows, "SELECT * FROM service_history WHERE owner = ? ORDER BY version DESC LIMIT ?", owner, limit)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]models.Change, 0, len(rows))
+	for _, row := range rows {
+		changes = append(changes, row.change())
+	}
+	return changes, nil
+}
+
+// stateAt replays the history of a zone up to and including version
+func (d *database) stateAt(owner string, version int) (map[int]models.ServiceEntry, error) {
+	rows := make([]historyRow, 0)
+	err := d.db.Select(&rows, "SELECT * FROM service_history WHERE owner = ? AND version <= ? ORDER BY version", owner, version)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[int]models.ServiceEntry)
+	for _, row := range rows {
+		change := row.change()
+		if change.After == nil {
+			delete(state, change.ServiceID)
+		} else {
+			state[change.ServiceID] = *change.After
+		}
+	}
+	return state, nil
+}
+
+func (d *database) latestVersion(owner string) (int, error) {
+	var version sql.NullInt64
+	err := d.db.QueryRow("SELECT MAX(version) FROM service_history WHERE owner = ?", owner).Scan(&version)
+	return int(version.Int64), err
+}
+
+func sameService(a, b models.ServiceEntry) bool {
+	a.Domain, b.Domain = "", ""
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+func diffStates(from, to map[int]models.ServiceEntry) []models.Change {
+	changes := make([]models.Change, 0)
+	for id, before := range from {
+		before := before
+		after, ok := to[id]
+		if !ok {
+			changes = append(changes, models.Change{ServiceID: id, Action: "delete", Before: &before})
+		} else if !sameService(before, after) {
+			changes = append(changes, models.Change{ServiceID: id, Action: "update", Before: &before, After: &after})
+		}
+	}
+	for id, after := range to {
+		after := after
+		if _, ok := from[id]; !ok {
+			changes = append(changes, models.Change{ServiceID: id, Action: "create", After: &after})
+		}
+	}
+	return changes
+}
+
+// DiffVersions returns the changes between two versions of a zone.
+// A to version of 0 means the latest version.
+func (d *database) DiffVersions(owner string, from, to int) ([]models.Change, error) {
+	var err error
+	if to == 0 {
+		to, err = d.latestVersion(owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+	before, err := d.stateAt(owner, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := d.stateAt(owner, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffStates(before, after), nil
+}
+
+// Rollback restores a zone to a previous version.
+// Like NewService, the transaction is returned uncommitted so Caddy can be synced first.
+// sql.ErrNoRows is returned for versions that are not in the owner's history,
+// which would otherwise replay to an empty zone.
+func (d *database) Rollback(owner, actor string, version int) (*sql.Tx, []models.Change, error) {
+	var exists int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM service_history WHERE owner = ? AND version = ?", owner, version).Scan(&exists)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists == 0 {
+		return nil, nil, sql.ErrNoRows
+	}
+	target, err := d.stateAt(owner, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	services := make([]models.ServiceEntry, 0)
+	err = tx.Select(&services, "SELECT * FROM services WHERE owner = ?", owner)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	current := make(map[int]models.ServiceEntry)
+	for _, service := range services {
+		current[service.ID] = service
+	}
+	changes := diffStates(current, target)
+	for _, change := range changes {
+		switch change.Action {
+		case "delete":
+			_, err = tx.Exec("DELETE FROM services WHERE owner = ? AND id = ?", owner, change.ServiceID)
+		case "create":
+			service := *change.After
+			service.Owner = owner
+			_, err = insertService(tx, service)
+		case "update":
+			service := *change.After
+			service.Owner = owner
+			_, err = updateService(tx, service)
+		}
+		if err == nil {
+			err = recordChange(tx, owner, actor, "rollback", change.Before, change.After)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	return tx.Tx, changes, nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+const (
+	createOutboxTable = `
+		CREATE TABLE IF NOT EXISTS caddy_outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			service_id INTEGER NOT NULL,
+			operation TEXT NOT NULL,
+			config TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			owner TEXT NOT NULL DEFAULT ''
+		)
+	`
+	createSyncTable = `
+		CREATE TABLE IF NOT EXISTS caddy_sync (
+			service_id INTEGER PRIMARY KEY,
+			status TEXT NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`
+)
+
+// QueueCaddy queues a change to the route of a service of owner in the transaction of the database change.
+// operation is update, with the route in config, or remove.
+func (d *database) QueueCaddy(tx execer, owner string, serviceID int, operation string, config []byte) error {
+	now := time.Now().UTC()
+	_, err := tx.Exec("INSERT INTO caddy_outbox (service_id, operation, config, next_attempt_at, created_at, owner) VALUES (?, ?, ?, ?, ?, ?)", serviceID, operation, string(config), now, now, owner)
+	if err != nil {
+		return err
+	}
+	return setSyncStatus(tx, serviceID, "pending")
+}
+
+func setSyncStatus(tx execer, serviceID int, status string) error {
+	_, err := tx.Exec("INSERT INTO caddy_sync (service_id, status, updated_at) VALUES (?, ?, ?) ON CONFLICT (service_id) DO UPDATE SET status = excluded.status, updated_at = excluded.updated_at", serviceID, status, time.Now().UTC())
+	return err
+}
+
+// PendingCaddy returns the queued operations in the order they were made
+func (d *database) PendingCaddy() ([]models.CaddyOperation, error) {
+	operations := make([]models.CaddyOperation, 0)
+	err := d.db.Select(&operations, "SELECT * FROM caddy_outbox ORDER BY id")
+	return operations, err
+}
+
+// PendingCaddyServices returns the services with operations that are not applied yet
+func (d *database) PendingCaddyServices() (map[int]bool, error) {
+	ids := make([]int, 0)
+	err := d.db.Select(&ids, "SELECT DISTINCT service_id FROM caddy_outbox")
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		pending[id] = true
+	}
+	return pending, nil
+}
+
+// CaddyApplied removes an applied operation from the queue
+func (d *database) CaddyApplied(operation models.CaddyOperation) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM caddy_outbox WHERE id = ?", operation.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Later operations keep the service pending
+	var remaining int
+	err = tx.Get(&remaining, "SELECT COUNT(*) FROM caddy_outbox WHERE service_id = ?", operation.ServiceID)
+	if err == nil && remaining == 0 {
+		err = setSyncStatus(tx, operation.ServiceID, "applied")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CaddyFailed records a failed attempt and schedules the next one
+func (d *database) CaddyFailed(operation models.CaddyOperation, reason string, next time.Time) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE caddy_outbox SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?", next.UTC(), reason, operation.ID)
+	if err == nil {
+		err = setSyncStatus(tx, operation.ServiceID, "failed: "+reason)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SyncStatus returns the sync status of every service of the owner that was ever queued
+func (d *database) SyncStatus(owner string) (map[int]string, error) {
+	rows, err := d.db.Query("SELECT caddy_sync.service_id, caddy_sync.status FROM caddy_sync JOIN services ON services.id = caddy_sync.service_id WHERE services.owner = ?", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
+		}
+		statuses[id] = status
+	}
+	return statuses, rows.Err()
+}
@@ -0,0 +1,301 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+func (d *database) NewReverseZone(zone models.ReverseZone) error {
+	_, err := d.db.Exec("INSERT INTO reverse_zones (owner, prefix, auto_ptr, approved) VALUES (?, ?, ?, ?)", zone.Owner, zone.Prefix, zone.AutoPTR, zone.Approved)
+	return err
+}
+
+func (d *database) GetReverseZone(id int) (models.ReverseZone, error) {
+	var zone models.ReverseZone
+	err := d.db.QueryRowx("SELECT * FROM reverse_zones WHERE id = ?", id).StructScan(&zone)
+	return zone, err
+}
+
+func (d *database) ApproveReverseZone(id int) error {
+	res, err := d.db.Exec("UPDATE reverse_zones SET approved = 1 WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// OverlappingReverseZone returns an approved zone of another owner sharing addresses with prefix, if any
+func (d *database) OverlappingReverseZone(owner string, prefix *net.IPNet) (*models.ReverseZone, error) {
+	zones, err := d.GetAllReverseZones()
+	if err != nil {
+		return nil, err
+	}
+	for i, zone := range zones {
+		if zone.Owner == owner || !zone.Approved {
+			continue
+		}
+		_, other, err := net.ParseCIDR(zone.Prefix)
+		if err != nil {
+			continue
+		}
+		if other.Contains(prefix.IP) || prefix.Contains(other.IP) {
+			return &zones[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *database) GetReverseZones(owner string) ([]models.ReverseZone, error) {
+	zones := make([]models.ReverseZone, 0)
+	err := d.db.Select(&zones, "SELECT * FROM reverse_zones WHERE owner = ?", owner)
+	return zones, err
+}
+
+func (d *database) GetAllReverseZones() ([]models.ReverseZone, error) {
+	zones := make([]models.ReverseZone, 0)
+	err := d.db.Select(&zones, "SELECT * FROM reverse_zones")
+	return zones, err
+}
+
+func (d *database) DeleteReverseZone(owner string, id int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM reverse_zones WHERE owner = ? AND id = ?", owner, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec("DELETE FROM ptr_records WHERE zone_id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *database) NewPTRRecord(owner string, record models.PTRRecord) error {
+	var zone models.ReverseZone
+	err := d.db.QueryRowx("SELECT * FROM reverse_zones WHERE owner = ? AND id = ?", owner, record.ZoneID).StructScan(&zone)
+	if err != nil {
+		return err
+	}
+	_, prefix, err := net.ParseCIDR(zone.Prefix)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(record.Address)
+	if ip == nil || !prefix.Contains(ip) {
+		return fmt.Errorf("%s is not within %s", record.Address, zone.Prefix)
+	}
+	if err := record.Normalize(); err != nil {
+		return err
+	}
+	_, err = d.db.Exec("INSERT INTO ptr_records (zone_id, address, hostname) VALUES (?, ?, ?)", record.ZoneID, ip.String(), record.Hostname)
+	return err
+}
+
+func (d *database) GetPTRRecords(owner string, zoneID int) ([]models.PTRRecord, error) {
+	records := make([]models.PTRRecord, 0)
+	err := d.db.Select(&records, "SELECT ptr_records.* FROM ptr_records JOIN reverse_zones ON reverse_zones.id = ptr_records.zone_id WHERE reverse_zones.owner = ? AND ptr_records.zone_id = ?", owner, zoneID)
+	return records, err
+}
+
+func (d *database) GetPTRRecord(owner string, id int) (models.PTRRecord, error) {
+	var record models.PTRRecord
+	err := d.db.QueryRowx("SELECT ptr_records.* FROM ptr_records JOIN reverse_zones ON reverse_zones.id = ptr_records.zone_id WHERE reverse_zones.owner = ? AND ptr_records.id = ?", owner, id).StructScan(&record)
+	return record, err
+}
+
+func (d *database) DeletePTRRecord(owner string, id int) error {
+	_, err := d.db.Exec("DELETE FROM ptr_records WHERE id = ? AND zone_id IN (SELECT id FROM reverse_zones WHERE owner = ?)", id, owner)
+	return err
+}
+
+// getPTRHostnames returns the hostnames explicitly configured for an address in a zone
+func (d *database) getPTRHostnames(zoneID int, address string) ([]string, error) {
+	hostnames := make([]string, 0)
+	err := d.db.Select(&hostnames, "SELECT hostname FROM ptr_records WHERE zone_id = ? AND address = ?", zoneID, address)
+	return hostnames, err
+}
+
+// getForwardHostnames returns the names of A/AAAA services pointing at an address owned by owner
+func (d *database) getForwardHostnames(owner, address string) ([]string, error) {
+	hostnames := make([]string, 0)
+	err := d.db.Select(&hostnames, `
+		SELECT CASE WHEN services.subdomain = '' THEN users.domain ELSE services.subdomain || '.' || users.domain END
+		FROM services JOIN users ON users.username = services.owner
+		WHERE services.owner = ? AND services.destination = ? AND services.forwarding = 0 AND services.dns_record_type IN ('A', 'AAAA')
+	`, owner, address)
+	return hostnames, err
+}
+
+// reverseAddress parses an in-addr.arpa or ip6.arpa name into the address it represents
+func reverseAddress(domain string) net.IP {
+	labels := strings.Split(domain, ".")
+	switch {
+	case len(labels) == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		ip := net.ParseIP(fmt.Sprintf("%s.%s.%s.%s", labels[3], labels[2], labels[1], labels[0]))
+		if ip == nil || ip.To4() == nil {
+			return nil
+		}
+		return ip
+	case len(labels) == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		hex := make([]byte, 0, 39)
+		for i := 31; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			hex = append(hex, labels[i][0])
+			if i%4 == 0 && i != 0 {
+				hex = append(hex, ':')
+			}
+		}
+		return net.ParseIP(string(hex))
+	}
+	return nil
+}
+
+// reverseZoneName returns the in-addr.arpa or ip6.arpa name of a prefix.
+// Prefixes not on an octet (nibble for IPv6) boundary are served at the name of the enclosing prefix.
+func reverseZoneName(prefix *net.IPNet) string {
+	size, bits := prefix.Mask.Size()
+	labels := make([]string, 0, 34)
+	if bits == 32 {
+		ip := prefix.IP.To4()
+		for i := size/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		return strings.Join(append(labels, "in-addr", "arpa"), ".")
+	}
+	ip := prefix.IP.To16()
+	for i := size/4 - 1; i >= 0; i-- {
+		nibble := ip[i/2] >> 4
+		if i%2 == 1 {
+			nibble = ip[i/2] & 0xf
+		}
+		labels = append(labels, strconv.FormatUint(uint64(nibble), 16))
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
+
+// getReverseZone returns the settings of the approved reverse zone containing domain.
+// The zone is named after its prefix and uses the zone settings of its owner.
+func (s *Storage) getReverseZone(domain string) (models.ZoneSettings, bool) {
+	zones, err := s.DB.GetAllReverseZones()
+	if err != nil {
+		return models.ZoneSettings{}, false
+	}
+	ip := reverseAddress(domain)
+	var zone *models.ReverseZone
+	name := ""
+	for i := range zones {
+		if !zones[i].Approved {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(zones[i].Prefix)
+		if err != nil {
+			continue
+		}
+		// Addresses outside the prefix do not belong to it, even below the same name
+		if ip != nil && !prefix.Contains(ip) {
+			continue
+		}
+		zoneName := reverseZoneName(prefix)
+		if dns.IsSubDomain(zoneName, domain) && len(zoneName) > len(name) {
+			zone = &zones[i]
+			name = zoneName
+		}
+	}
+	if zone == nil {
+		return models.ZoneSettings{}, false
+	}
+	owner, err := s.DB.GetUser(zone.Owner)
+	if err != nil {
+		return models.ZoneSettings{}, false
+	}
+	settings, err := s.ZoneSettings(owner)
+	if err != nil {
+		return models.ZoneSettings{}, false
+	}
+	settings.Domain = name
+	return settings, true
+}
+
+// getReverseDNS resolves a PTR query against the hosted reverse zones
+func (s *Storage) getReverseDNS(domain string) []dnsCacheItem {
+	ip := reverseAddress(domain)
+	if ip == nil {
+		return nil
+	}
+	zones, err := s.DB.GetAllReverseZones()
+	if err != nil {
+		return nil
+	}
+	// Pick the most specific prefix containing the address
+	var zone *models.ReverseZone
+	bestSize := -1
+	for i := range zones {
+		if !zones[i].Approved {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(zones[i].Prefix)
+		if err != nil || !prefix.Contains(ip) {
+			continue
+		}
+		if size, _ := prefix.Mask.Size(); size > bestSize {
+			zone = &zones[i]
+			bestSize = size
+		}
+	}
+	if zone == nil {
+		return nil
+	}
+	log.Println("DB Accessed! This should not happen often.", domain)
+	hostnames, err := s.DB.getPTRHostnames(zone.ID, ip.String())
+	if err != nil {
+		return nil
+	}
+	if zone.AutoPTR {
+		generated, err := s.DB.getForwardHostnames(zone.Owner, ip.String())
+		if err == nil {
+			hostnames = append(hostnames, generated...)
+		}
+	}
+	if len(hostnames) == 0 {
+		s.Cache.SetEmpty(domain)
+		return nil
+	}
+	for _, hostname := range hostnames {
+		s.Cache.Set(domain, dns.Fqdn(hostname), "PTR")
+	}
+	items, ok := s.Cache.Get(domain)
+	if !ok {
+		return nil
+	}
+	return items
+}
+
+// FlushReverse removes the cached PTR answer for an address
+func (s *Storage) FlushReverse(address string) {
+	name, err := dns.ReverseAddr(address)
+	if err != nil {
+		return
+	}
+	s.Cache.Delete(strings.TrimSuffix(name, "."))
+}
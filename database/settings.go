@@ -0,0 +1,196 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+type zoneSettingsRow struct {
+	Owner       string `db:"owner"`
+	DefaultTTL  uint32 `db:"default_ttl"`
+	Refresh     uint32 `db:"refresh"`
+	Retry       uint32 `db:"retry"`
+	Expire      uint32 `db:"expire"`
+	Minimum     uint32 `db:"minimum"`
+	PrimaryNS   string `db:"primary_ns"`
+	Hostmaster  string `db:"hostmaster"`
+	Nameservers string `db:"nameservers"`
+	Serial      uint32 `db:"serial"`
+}
+
+// dateSerial returns the serial following current in YYYYMMDDnn format
+func dateSerial(current uint32, now time.Time) uint32 {
+	year, month, day := now.UTC().Date()
+	today := uint32(year*1000000 + int(month)*10000 + day*100)
+	if current < today {
+		return today
+	}
+	return current + 1
+}
+
+// bumpSerial increments the serial of a zone as part of a change
+func bumpSerial(tx execer, owner string) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO zone_settings (owner) VALUES (?)", owner)
+	if err != nil {
+		return err
+	}
+	// The date based serial is computed in Go so both statements agree on the day
+	today := dateSerial(0, time.Now())
+	_, err = tx.Exec("UPDATE zone_settings SET serial = MAX(serial + 1, ?) WHERE owner = ?", today, owner)
+	return err
+}
+
+func (d *database) getZoneSettings(owner string) (zoneSettingsRow, error) {
+	row := zoneSettingsRow{Owner: owner}
+	err := d.db.QueryRowx("SELECT * FROM zone_settings WHERE owner = ?", owner).StructScan(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return row, nil
+	}
+	return row, err
+}
+
+// UpdateZoneSettings saves the editable settings of a zone and bumps its serial
+func (d *database) UpdateZoneSettings(owner string, settings models.ZoneSettings) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = bumpSerial(tx, owner)
+	if err == nil {
+		_, err = tx.Exec("UPDATE zone_settings SET default_ttl = ?, refresh = ?, retry = ?, expire = ?, minimum = ?, primary_ns = ?, hostmaster = ?, nameservers = ? WHERE owner = ?", settings.DefaultTTL, settings.Refresh, settings.Retry, settings.Expire, settings.Minimum, settings.PrimaryNS, settings.Hostmaster, strings.Join(settings.Nameservers, ","), owner)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ZoneSettings returns the settings of a user's zone with defaults filled in
+func (s *Storage) ZoneSettings(user models.User) (models.ZoneSettings, error) {
+	row, err := s.DB.getZoneSettings(user.Username)
+	if err != nil {
+		return models.ZoneSettings{}, err
+	}
+	settings := models.ZoneSettings{
+		Domain:      user.Domain,
+		DefaultTTL:  row.DefaultTTL,
+		Refresh:     row.Refresh,
+		Retry:       row.Retry,
+		Expire:      row.Expire,
+		Minimum:     row.Minimum,
+		PrimaryNS:   row.PrimaryNS,
+		Hostmaster:  row.Hostmaster,
+		Nameservers: make([]string, 0),
+		Serial:      row.Serial,
+	}
+	if row.Nameservers != "" {
+		settings.Nameservers = strings.Split(row.Nameservers, ",")
+	}
+	if settings.DefaultTTL == 0 {
+		settings.DefaultTTL = 60
+	}
+	if settings.Refresh == 0 {
+		settings.Refresh = 3600
+	}
+	if settings.Retry == 0 {
+		settings.Retry = 600
+	}
+	if settings.Expire == 0 {
+		settings.Expire = 604800
+	}
+	if settings.Minimum == 0 {
+		settings.Minimum = 60
+	}
+	if len(settings.Nameservers) == 0 {
+		settings.Nameservers = s.Nameservers
+	}
+	if len(settings.Nameservers) == 0 {
+		settings.Nameservers = []string{"ns1." + user.Domain, "ns2." + user.Domain}
+	}
+	if settings.PrimaryNS == "" {
+		settings.PrimaryNS = settings.Nameservers[0]
+	}
+	if settings.Hostmaster == "" {
+		settings.Hostmaster = "hostmaster@" + user.Domain
+	}
+	if settings.Serial == 0 {
+		settings.Serial = dateSerial(0, time.Now())
+	}
+	return settings, nil
+}
+
+// HostmasterMbox converts a hostmaster email address to the mailbox name used in SOA records
+func HostmasterMbox(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return dns.Fqdn(email)
+	}
+	return dns.Fqdn(strings.ReplaceAll(local, ".", "\\.") + "." + domain)
+}
+
+type zoneCacheEntry struct {
+	Settings models.ZoneSettings
+	Expires  time.Time
+}
+
+// zoneCache keeps zone settings for the DNS handler.
+// Entries expire quickly so serials bumped by changes are picked up.
+type zoneCache struct {
+	lock  sync.RWMutex
+	Items map[string]zoneCacheEntry
+}
+
+func newZoneCache() *zoneCache {
+	return &zoneCache{sync.RWMutex{}, make(map[string]zoneCacheEntry)}
+}
+
+// GetZone returns the settings of the verified zone containing domain
+func (s *Storage) GetZone(domain string) (models.ZoneSettings, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return models.ZoneSettings{}, false
+	}
+	rootDomain := labels[len(labels)-2] + "." + labels[len(labels)-1]
+	// Reverse zones are as long as their prefix, so reverse names are cached on their own
+	reverse := strings.HasSuffix(domain, ".in-addr.arpa") || strings.HasSuffix(domain, ".ip6.arpa")
+	if reverse {
+		rootDomain = domain
+	}
+
+	s.zones.lock.RLock()
+	entry, ok := s.zones.Items[rootDomain]
+	s.zones.lock.RUnlock()
+	if ok && time.Now().Before(entry.Expires) {
+		return entry.Settings, entry.Settings.Domain != ""
+	}
+
+	var settings models.ZoneSettings
+	if reverse {
+		settings, _ = s.getReverseZone(domain)
+	} else if owner, err := s.DB.GetDomainOwner(rootDomain); err == nil && owner.Verified {
+		settings, err = s.ZoneSettings(owner)
+		if err != nil {
+			return models.ZoneSettings{}, false
+		}
+	}
+	// Unknown zones are cached too so they do not hit the database on every query
+	s.zones.lock.Lock()
+	s.zones.Items[rootDomain] = zoneCacheEntry{settings, time.Now().Add(30 * time.Second)}
+	s.zones.lock.Unlock()
+	return settings, settings.Domain != ""
+}
+
+// FlushZone forgets the cached settings of a zone
+func (s *Storage) FlushZone(domain string) {
+	s.zones.lock.Lock()
+	delete(s.zones.Items, domain)
+	s.zones.lock.Unlock()
+}
@@ -1,42 +1,150 @@
 package database
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"strings"
+	"sync"
 )
 
 type Storage struct {
-	Cache    *dnsCache
-	DB       *database
-	publicIP string
+	Cache *dnsCache
+	DB    *database
+	// Addresses of the reverse proxy returned for forwarded services
+	ipLock     sync.RWMutex
+	publicIPv4 []string
+	publicIPv6 []string
+	// Nameservers are the hostnames of this server used for synthesized NS records
+	Nameservers []string
+	// Upstream is the resolver used to flatten ALIAS records
+	Upstream string
+	aliases  *aliasCache
+	// Zone settings used by the DNS handler
+	zones *zoneCache
 }
 
-func NewStorage(publicIP string) (*Storage, error) {
+func NewStorage(publicIPv4, publicIPv6 []string) (*Storage, error) {
+	if err := checkFamily(publicIPv4, true); err != nil {
+		return nil, err
+	}
+	if err := checkFamily(publicIPv6, false); err != nil {
+		return nil, err
+	}
 	db, err := newDatabase()
 	if err != nil {
 		return nil, err
 	}
 	return &Storage{
-		Cache:    newCache(),
-		DB:       db,
-		publicIP: publicIP,
+		Cache:      newCache(),
+		DB:         db,
+		publicIPv4: publicIPv4,
+		publicIPv6: publicIPv6,
+		Upstream:   "1.1.1.1:53",
+		aliases:    newAliasCache(),
+		zones:      newZoneCache(),
 	}, nil
 }
 
+// PublicIPs returns the current IPv4 and IPv6 addresses of the reverse proxy
+func (s *Storage) PublicIPs() ([]string, []string) {
+	s.ipLock.RLock()
+	defer s.ipLock.RUnlock()
+	return s.publicIPv4, s.publicIPv6
+}
+
+// SetPublicIPs replaces the addresses of the reverse proxy.
+// A nil list leaves that address family untouched.
+// Cached answers using the old addresses are flushed and the change is recorded as an event.
+func (s *Storage) SetPublicIPs(publicIPv4, publicIPv6 []string) bool {
+	s.ipLock.Lock()
+	old := append(append([]string{}, s.publicIPv4...), s.publicIPv6...)
+	changed := false
+	if publicIPv4 != nil && !sameList(s.publicIPv4, publicIPv4) {
+		s.publicIPv4 = publicIPv4
+		changed = true
+	}
+	if publicIPv6 != nil && !sameList(s.publicIPv6, publicIPv6) {
+		s.publicIPv6 = publicIPv6
+		changed = true
+	}
+	current := append(append([]string{}, s.publicIPv4...), s.publicIPv6...)
+	s.ipLock.Unlock()
+	if !changed {
+		return false
+	}
+	// Forwarded names are cached with every proxy address so flushing by the old ones is enough
+	s.Cache.DeleteByDest(old)
+	message := fmt.Sprintf("Public IP changed from [%s] to [%s]", strings.Join(old, ","), strings.Join(current, ","))
+	log.Println(message)
+	if err := s.DB.NewEvent("", "public_ip", message); err != nil {
+		log.Printf("Failed to record event: %s\n", err.Error())
+	}
+	return true
+}
+
+// checkFamily makes sure proxy addresses are answered in A records when ipv4 is set and in AAAA records otherwise
+func checkFamily(addresses []string, ipv4 bool) error {
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid proxy address %s", address)
+		case ipv4 && ip.To4() == nil:
+			return fmt.Errorf("proxy address %s is not an IPv4 address", address)
+		case !ipv4 && ip.To4() != nil:
+			return fmt.Errorf("proxy address %s is not an IPv6 address", address)
+		}
+	}
+	return nil
+}
+
+func sameList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, item := range a {
+		if !contains(b, item) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Storage) GetDNS(domain string) []dnsCacheItem {
+	return s.GetDNSTrace(domain, nil)
+}
+
+// GetDNSTrace resolves a name like GetDNS and explains each decision in trace, which may be nil
+func (s *Storage) GetDNSTrace(domain string, trace *Trace) []dnsCacheItem {
 	if domain[len(domain)-1] == '.' {
 		domain = domain[:len(domain)-1]
 	}
 	domain = strings.ToLower(domain)
+	if strings.HasPrefix(domain, "_acme-challenge.") {
+		if items := s.getACMEChallenge(domain); items != nil {
+			trace.Add("Answered with %d active ACME DNS-01 challenges", len(items))
+			return items
+		}
+		trace.Add("No active ACME DNS-01 challenge, resolving as a normal name")
+	}
 	// Check if the domain is in the cache
 	items, ok := s.Cache.Get(domain)
 	if ok {
+		trace.setCacheHit()
+		trace.Add("Cache hit for %s with %d records", domain, len(items))
 		return items
 	}
+	trace.Add("Cache miss for %s", domain)
+	if strings.HasSuffix(domain, ".in-addr.arpa") || strings.HasSuffix(domain, ".ip6.arpa") {
+		trace.Add("Reverse name, looking up hosted reverse zones")
+		return s.getReverseDNS(domain)
+	}
 	// Split the domain to find root domain
 	domainList := strings.Split(domain, ".")
 	// Prevent index out of range
 	if len(domainList) < 2 {
+		trace.Add("%s has no root domain", domain)
 		return nil
 	}
 	// Get the root domain
@@ -45,8 +153,15 @@ func (s *Storage) GetDNS(domain string) []dnsCacheItem {
 	log.Println("DB Accessed! This should not happen often.", domain)
 	owner, err := s.DB.GetDomainOwner(rootDomain)
 	if err != nil {
+		trace.Add("No zone found for %s", rootDomain)
 		return nil
 	}
+	trace.setZone(rootDomain, owner.Username)
+	if !owner.Verified {
+		trace.Add("Zone %s is not verified", rootDomain)
+		return nil
+	}
+	trace.Add("Matched zone %s owned by %s", rootDomain, owner.Username)
 	// Get the subdomain (remove root domain)
 	var subdomain string
 	if len(domain) == len(rootDomain) {
@@ -54,19 +169,41 @@ func (s *Storage) GetDNS(domain string) []dnsCacheItem {
 	} else {
 		subdomain = domain[:len(domain)-len(rootDomain)-1]
 	}
+	// Names beneath a delegated subdomain are answered with a referral
+	if referral := s.getReferral(owner, rootDomain, subdomain); referral != nil {
+		trace.Add("%s is delegated to %s, answering with a referral", domain, referral[0].Domain)
+		s.Cache.SetReferral(domain, referral)
+		return referral
+	}
 	// Get services from database
 	services, err := s.DB.GetServicesBySubdomain(owner.Username, subdomain)
+	trace.setServices(services)
 	if err != nil || len(services) == 0 {
+		trace.Add("No services for subdomain %q, caching the empty answer", subdomain)
 		// Cache empty
 		s.Cache.SetEmpty(domain)
 		return nil
 	}
+	trace.Add("Found %d services for subdomain %q", len(services), subdomain)
+	forwarded := false
 	for _, service := range services {
 		if service.Forwarding {
-			// If it is, add it to the cache
-			s.Cache.Set(domain, s.publicIP, service.DNSRecordType)
+			// Forwarded names always answer with the proxy's addresses for both families
+			if forwarded {
+				continue
+			}
+			forwarded = true
+			publicIPv4, publicIPv6 := s.PublicIPs()
+			trace.Add("Service %d is forwarded, answering with the proxy addresses %v %v", service.ID, publicIPv4, publicIPv6)
+			for _, ip := range publicIPv4 {
+				s.Cache.Set(domain, ip, "A")
+			}
+			for _, ip := range publicIPv6 {
+				s.Cache.Set(domain, ip, "AAAA")
+			}
 		} else {
 			// If forwarding is not enabled, directly return the destination
+			trace.Add("Service %d is a %s record to %s", service.ID, service.DNSRecordType, service.Destination)
 			s.Cache.Set(domain, service.Destination, service.DNSRecordType)
 		}
 	}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+// Trace records the decisions taken while resolving a name.
+// All methods are safe to call on a nil Trace so the normal path pays nothing for it.
+type Trace struct {
+	Steps    []string              `json:"steps"`
+	Zone     string                `json:"zone,omitempty"`
+	Owner    string                `json:"owner,omitempty"`
+	CacheHit bool                  `json:"cache_hit"`
+	Services []models.ServiceEntry `json:"services"`
+}
+
+func NewTrace() *Trace {
+	return &Trace{Steps: make([]string, 0), Services: make([]models.ServiceEntry, 0)}
+}
+
+// Add appends a step to the explanation
+func (t *Trace) Add(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, fmt.Sprintf(format, args...))
+}
+
+func (t *Trace) setZone(zone, owner string) {
+	if t == nil {
+		return
+	}
+	t.Zone = zone
+	t.Owner = owner
+}
+
+func (t *Trace) setCacheHit() {
+	if t == nil {
+		return
+	}
+	t.CacheHit = true
+}
+
+func (t *Trace) setServices(services []models.ServiceEntry) {
+	if t == nil {
+		return
+	}
+	t.Services = services
+}
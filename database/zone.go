@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+// recordKey identifies a record by name, type and canonical data
+func recordKey(service models.ServiceEntry) string {
+	dest := service.Destination
+	rr, err := dns.NewRR(fmt.Sprintf("x. 60 IN %s %s", service.DNSRecordType, service.Destination))
+	if err == nil && rr != nil {
+		dest = strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return strings.ToLower(service.Subdomain + " " + service.DNSRecordType + " " + dest)
+}
+
+// addressTypes answer address queries and conflict with a forwarded service of the same name
+var addressTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true, "ALIAS": true}
+
+// DiffZone compares imported records with the stored plain records of owner.
+// Forwarded services are managed through Caddy and are never touched by an import.
+// Their exported A/AAAA records and records that fail validation are skipped.
+func (s *Storage) DiffZone(owner string, records []models.ServiceEntry) (models.ZoneDiff, error) {
+	diff := models.ZoneDiff{
+		Add:     make([]models.ServiceEntry, 0),
+		Remove:  make([]models.ServiceEntry, 0),
+		Skipped: make([]string, 0),
+	}
+	user, err := s.DB.GetUser(owner)
+	if err != nil {
+		return diff, err
+	}
+	existing, err := s.DB.GetAllServices(owner)
+	if err != nil {
+		return diff, err
+	}
+	forwarded := make(map[string]bool)
+	for _, service := range existing {
+		if service.Forwarding {
+			forwarded[service.Subdomain] = true
+		}
+	}
+	valid := make([]models.ServiceEntry, 0, len(records))
+	for _, record := range records {
+		description := fmt.Sprintf("%s %s %s", record.Subdomain, record.DNSRecordType, record.Destination)
+		record.Owner = owner
+		record.Domain = user.Domain
+		if message := record.Check(); message != "" {
+			diff.Skipped = append(diff.Skipped, description+": "+message)
+			continue
+		}
+		if forwarded[record.Subdomain] && addressTypes[record.DNSRecordType] {
+			diff.Skipped = append(diff.Skipped, description+": answered by a forwarded service")
+			continue
+		}
+		valid = append(valid, record)
+	}
+	records = valid
+	wanted := make(map[string]bool)
+	for _, record := range records {
+		wanted[recordKey(record)] = true
+	}
+	current := make(map[string]bool)
+	for _, service := range existing {
+		if service.Forwarding {
+			continue
+		}
+		key := recordKey(service)
+		current[key] = true
+		if !wanted[key] {
+			diff.Remove = append(diff.Remove, service)
+		}
+	}
+	for _, record := range records {
+		key := recordKey(record)
+		if current[key] {
+			continue
+		}
+		// Avoid adding duplicates present in the zone file
+		current[key] = true
+		diff.Add = append(diff.Add, record)
+	}
+	return diff, nil
+}
+
+// ApplyZoneDiff applies all changes of a diff in a single transaction
+func (s *Storage) ApplyZoneDiff(owner string, diff models.ZoneDiff) error {
+	tx, _, err := s.DB.ImportZone(owner, diff, nil)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.Cache.Clear()
+	return nil
+}
+
+// ImportZone applies a diff and creates the forwarded services of an import in one transaction.
+// The transaction is returned uncommitted with the IDs of the forwarded services so their routes can be queued in it.
+func (d *database) ImportZone(owner string, diff models.ZoneDiff, forward []models.ServiceEntry) (*sql.Tx, []int, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, service := range diff.Remove {
+		before, err := serviceInTx(tx, owner, service.ID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM services WHERE owner = ? AND id = ?", owner, service.ID)
+		}
+		if err == nil {
+			err = recordChange(tx, owner, owner, "delete", &before, nil)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	for _, service := range diff.Add {
+		_, err := createService(tx, models.ServiceEntry{
+			Owner:         owner,
+			Subdomain:     service.Subdomain,
+			DNSRecordType: service.DNSRecordType,
+			Destination:   service.Destination,
+		})
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	ids := make([]int, 0, len(forward))
+	for _, service := range forward {
+		service.ID = 0
+		service.Owner = owner
+		id, err := createService(tx, service)
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+	}
+	return tx.Tx, ids, nil
+}
@@ -0,0 +1,193 @@
+package database
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+// newTestStorage opens a fresh database in a temporary directory holding a verified user "alice" of example.com
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewStorage([]string{"192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storage.DB.Close()
+		os.Chdir(wd)
+	})
+	if err := storage.DB.NewUser(models.User{Username: "alice", Password: "secret", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DB.VerifyUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func addService(t *testing.T, storage *Storage, service models.ServiceEntry) {
+	t.Helper()
+	service.Owner = "alice"
+	tx, _, err := storage.DB.NewService(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func describe(services []models.ServiceEntry) []string {
+	descriptions := make([]string, 0, len(services))
+	for _, service := range services {
+		descriptions = append(descriptions, service.Subdomain+" "+service.DNSRecordType+" "+service.Destination)
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+func TestDiffZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []models.ServiceEntry
+		add     []string
+		remove  []string
+		skipped []string
+	}{
+		{
+			name: "unchanged",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+			},
+		},
+		{
+			name: "equal rdata in another form",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10   MAIL.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+			},
+		},
+		{
+			name: "added and removed",
+			records: []models.ServiceEntry{
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+				{Subdomain: "mail", DNSRecordType: "AAAA", Destination: "2001:db8::10"},
+			},
+			add:    []string{"mail AAAA 2001:db8::10"},
+			remove: []string{" MX 10 mail.example.com."},
+		},
+		{
+			name: "duplicates are added once",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+				{Subdomain: "new", DNSRecordType: "TXT", Destination: "\"x\""},
+				{Subdomain: "new", DNSRecordType: "TXT", Destination: "\"x\""},
+			},
+			add: []string{"new TXT \"x\""},
+		},
+		{
+			name: "forwarded names keep their service",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+				{Subdomain: "www", DNSRecordType: "A", Destination: "192.0.2.1"},
+				{Subdomain: "www", DNSRecordType: "ALIAS", Destination: "example.net."},
+				{Subdomain: "www", DNSRecordType: "TXT", Destination: "\"kept\""},
+			},
+			add: []string{"www TXT \"kept\""},
+			skipped: []string{
+				"www A 192.0.2.1: answered by a forwarded service",
+				"www ALIAS example.net.: answered by a forwarded service",
+			},
+		},
+		{
+			name: "invalid records are skipped",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+				{Subdomain: "", DNSRecordType: "CNAME", Destination: "example.net."},
+				{Subdomain: "_nameserver-verify", DNSRecordType: "TXT", Destination: "\"token\""},
+			},
+			skipped: []string{
+				" CNAME example.net.: dns_record_type: CNAME is not allowed at the zone apex, use ALIAS instead",
+				"_nameserver-verify TXT \"token\": subdomain: _nameserver-verify is reserved",
+			},
+		},
+		{
+			name: "internationalized names are normalized",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+				{Subdomain: "bücher", DNSRecordType: "CNAME", Destination: "bücher.example."},
+			},
+			add: []string{"xn--bcher-kva CNAME xn--bcher-kva.example."},
+		},
+	}
+	storage := newTestStorage(t)
+	addService(t, storage, models.ServiceEntry{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."})
+	addService(t, storage, models.ServiceEntry{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"})
+	addService(t, storage, models.ServiceEntry{Subdomain: "www", Destination: "10.0.0.1", Port: 8080, Forwarding: true})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff, err := storage.DiffZone("alice", test.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(what string, got, want []string) {
+				sort.Strings(want)
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("%s = %q, want %q", what, got, want)
+				}
+			}
+			check("add", describe(diff.Add), append([]string{}, test.add...))
+			check("remove", describe(diff.Remove), append([]string{}, test.remove...))
+			skipped := append([]string{}, diff.Skipped...)
+			sort.Strings(skipped)
+			check("skipped", skipped, append([]string{}, test.skipped...))
+		})
+	}
+}
+
+func TestApplyZoneDiff(t *testing.T) {
+	storage := newTestStorage(t)
+	addService(t, storage, models.ServiceEntry{Subdomain: "old", DNSRecordType: "A", Destination: "192.0.2.20"})
+	addService(t, storage, models.ServiceEntry{Subdomain: "www", Destination: "10.0.0.1", Port: 8080, Forwarding: true})
+	records := []models.ServiceEntry{{Subdomain: "new", DNSRecordType: "AAAA", Destination: "2001:db8::20"}}
+	diff, err := storage.DiffZone("alice", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.ApplyZoneDiff("alice", diff); err != nil {
+		t.Fatal(err)
+	}
+	services, err := storage.DB.GetAllServices("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := describe(services)
+	want := []string{"new AAAA 2001:db8::20", "www  10.0.0.1"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("services = %q, want %q", got, want)
+	}
+	// Applying the same records again changes nothing
+	diff, err = storage.DiffZone("alice", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Add) != 0 || len(diff.Remove) != 0 {
+		t.Errorf("second diff = %+v", diff)
+	}
+}
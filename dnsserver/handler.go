@@ -0,0 +1,170 @@
+package dnsserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+// NewHandler answers DNS queries from the records held in storage
+func NewHandler(storage *database.Storage) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(Answer(storage, r, nil))
+	})
+}
+
+// Answer builds the reply to a query. Each decision is explained in trace unless it is nil.
+func Answer(storage *database.Storage, r *dns.Msg, trace *database.Trace) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	qType := dns.TypeToString[r.Question[0].Qtype]
+	qName := r.Question[0].Name
+	var ttl uint32 = 60
+	zone, hasZone := storage.GetZone(qName)
+	if hasZone {
+		ttl = zone.DefaultTTL
+	}
+	apex := hasZone && strings.EqualFold(strings.TrimSuffix(qName, "."), zone.Domain)
+
+	dnsRecords := storage.GetDNSTrace(qName, trace)
+	// Cached empty answers are empty but not nil
+	if len(dnsRecords) == 0 && !apex {
+		trace.Add("No records, answering NXDOMAIN")
+		m.SetRcode(r, dns.RcodeNameError)
+		if hasZone {
+			m.Ns = append(m.Ns, negativeSOA(zone))
+		}
+		return m
+	}
+	if len(dnsRecords) > 0 && dnsRecords[0].Referral {
+		return referral(m, dnsRecords, ttl)
+	}
+	explicitNS := false
+	aliasFailed := false
+	for _, dnsRecord := range dnsRecords {
+		if dnsRecord.RecordType == "NS" {
+			explicitNS = true
+		}
+		if dnsRecord.RecordType == "ALIAS" {
+			answers, ok := flattenAlias(storage, qName, r.Question[0].Qtype, dnsRecord.Dest, trace)
+			aliasFailed = aliasFailed || !ok
+			m.Answer = append(m.Answer, answers...)
+			continue
+		}
+		if dnsRecord.RecordType == qType || dnsRecord.RecordType == "CNAME" {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", qName, ttl, dnsRecord.RecordType, dnsRecord.Dest))
+			if err != nil {
+				fmt.Println(fmt.Errorf("Failed to create RR: %s\n", err.Error()))
+				trace.Add("Skipped invalid %s record %s: %s", dnsRecord.RecordType, dnsRecord.Dest, err.Error())
+				continue
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if apex {
+		switch r.Question[0].Qtype {
+		case dns.TypeSOA:
+			trace.Add("Synthesized SOA with serial %d", zone.Serial)
+			m.Answer = append(m.Answer, soa(zone, ttl))
+		case dns.TypeNS:
+			if !explicitNS {
+				trace.Add("Synthesized NS records %v", zone.Nameservers)
+				m.Answer = append(m.Answer, nameservers(zone, ttl)...)
+			}
+		}
+	}
+	if len(m.Answer) == 0 && aliasFailed {
+		// A NODATA answer would be cached by resolvers although the target may resolve on the next try
+		trace.Add("ALIAS could not be flattened, answering SERVFAIL")
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return m
+	}
+	if len(m.Answer) == 0 && hasZone {
+		trace.Add("No records of type %s, answering NODATA", qType)
+		m.Ns = append(m.Ns, negativeSOA(zone))
+		return m
+	}
+	trace.Add("Answering with %d records", len(m.Answer))
+	return m
+}
+
+func soa(zone models.ZoneSettings, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(zone.Domain), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(zone.PrimaryNS),
+		Mbox:    database.HostmasterMbox(zone.Hostmaster),
+		Serial:  zone.Serial,
+		Refresh: zone.Refresh,
+		Retry:   zone.Retry,
+		Expire:  zone.Expire,
+		Minttl:  zone.Minimum,
+	}
+}
+
+// negativeSOA is added to negative answers so resolvers cache them for the zone minimum (RFC 2308)
+func negativeSOA(zone models.ZoneSettings) *dns.SOA {
+	ttl := zone.DefaultTTL
+	if zone.Minimum < ttl {
+		ttl = zone.Minimum
+	}
+	return soa(zone, ttl)
+}
+
+func nameservers(zone models.ZoneSettings, ttl uint32) []dns.RR {
+	rrs := make([]dns.RR, 0, len(zone.Nameservers))
+	for _, ns := range zone.Nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(zone.Domain), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(ns),
+		})
+	}
+	return rrs
+}
+
+// referral points the resolver at the nameservers of a delegated subdomain
+func referral(m *dns.Msg, dnsRecords []database.DNSRecord, ttl uint32) *dns.Msg {
+	m.Authoritative = false
+	for _, dnsRecord := range dnsRecords {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(dnsRecord.Domain), ttl, dnsRecord.RecordType, dnsRecord.Dest))
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to create RR: %s\n", err.Error()))
+			continue
+		}
+		if dnsRecord.RecordType == "NS" {
+			m.Ns = append(m.Ns, rr)
+		} else {
+			m.Extra = append(m.Extra, rr)
+		}
+	}
+	return m
+}
+
+// flattenAlias synthesizes A/AAAA answers for an ALIAS record, ok is false when the upstream failed
+func flattenAlias(storage *database.Storage, qName string, qType uint16, target string, trace *database.Trace) ([]dns.RR, bool) {
+	if qType != dns.TypeA && qType != dns.TypeAAAA {
+		return nil, true
+	}
+	addresses, ttl, err := storage.ResolveAlias(target, qType)
+	if err != nil {
+		fmt.Println(fmt.Errorf("Failed to resolve ALIAS target %s: %s\n", target, err.Error()))
+		trace.Add("Failed to flatten ALIAS to %s: %s", target, err.Error())
+		return nil, false
+	}
+	trace.Add("Flattened ALIAS to %s into %v with TTL %d", target, addresses, ttl)
+	answers := make([]dns.RR, 0, len(addresses))
+	for _, address := range addresses {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", qName, ttl, dns.TypeToString[qType], address))
+		if err != nil {
+			fmt.Println(fmt.Errorf("Failed to create RR: %s\n", err.Error()))
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	return answers, true
+}
@@ -0,0 +1,260 @@
+package dnsserver
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+// upstream is a local stand-in for the resolver ALIAS targets are flattened with
+type upstream struct {
+	lock    sync.Mutex
+	queries map[string]int
+	// records maps a target to its A record TTL, targets without one answer SERVFAIL
+	records map[string]uint32
+}
+
+func (u *upstream) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	u.lock.Lock()
+	u.queries[q.Name]++
+	ttl, ok := u.records[q.Name]
+	u.lock.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if !ok {
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	if q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer,
+			&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("198.51.100.1")},
+			&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl * 2}, A: net.ParseIP("198.51.100.2")},
+		)
+	}
+	w.WriteMsg(m)
+}
+
+func (u *upstream) count(name string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.queries[name]
+}
+
+// startUpstream serves u on a local UDP port and returns its address
+func startUpstream(t *testing.T, u *upstream) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: u, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// newStorage opens a fresh database in a temporary directory with a verified zone per domain,
+// each holding an apex ALIAS to the given target
+func newStorage(t *testing.T, aliases map[string]string) *database.Storage {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := database.NewStorage([]string{"192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storage.DB.Close()
+		os.Chdir(wd)
+	})
+	for domain, target := range aliases {
+		if err := storage.DB.NewUser(models.User{Username: domain, Password: "secret", Domain: domain}); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.DB.VerifyUser(domain); err != nil {
+			t.Fatal(err)
+		}
+		tx, _, err := storage.DB.NewService(models.ServiceEntry{Owner: domain, DNSRecordType: "ALIAS", Destination: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage
+}
+
+func query(storage *database.Storage, name string, qType uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qType)
+	return Answer(storage, r, nil)
+}
+
+func TestAliasFlattening(t *testing.T) {
+	u := &upstream{
+		queries: make(map[string]int),
+		records: map[string]uint32{"target.example.net.": 120, "short.example.net.": 1},
+	}
+	storage := newStorage(t, map[string]string{
+		"example.com": "target.example.net.",
+		"example.org": "short.example.net.",
+		"example.edu": "broken.example.net.",
+	})
+	storage.Upstream = startUpstream(t, u)
+
+	tests := []struct {
+		name    string
+		domain  string
+		qType   uint16
+		rcode   int
+		answers int
+		maxTTL  uint32
+		target  string
+		// queries is the number of upstream queries for target after the query
+		queries int
+		wait    time.Duration
+	}{
+		{"flattened", "example.com", dns.TypeA, dns.RcodeSuccess, 2, 120, "target.example.net.", 1, 0},
+		{"cached", "example.com", dns.TypeA, dns.RcodeSuccess, 2, 120, "target.example.net.", 1, 0},
+		{"no addresses of the family", "example.com", dns.TypeAAAA, dns.RcodeSuccess, 0, 0, "target.example.net.", 2, 0},
+		{"other types are not flattened", "example.com", dns.TypeTXT, dns.RcodeSuccess, 0, 0, "target.example.net.", 2, 0},
+		{"short ttl", "example.org", dns.TypeA, dns.RcodeSuccess, 2, 1, "short.example.net.", 1, 0},
+		{"short ttl expired", "example.org", dns.TypeA, dns.RcodeSuccess, 2, 1, "short.example.net.", 2, 1100 * time.Millisecond},
+		{"upstream failure", "example.edu", dns.TypeA, dns.RcodeServerFailure, 0, 0, "broken.example.net.", 1, 0},
+		{"failures are not cached", "example.edu", dns.TypeA, dns.RcodeServerFailure, 0, 0, "broken.example.net.", 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			time.Sleep(test.wait)
+			m := query(storage, test.domain, test.qType)
+			if m.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if len(m.Answer) != test.answers {
+				t.Fatalf("answers = %v, want %d", m.Answer, test.answers)
+			}
+			for _, rr := range m.Answer {
+				if rr.Header().Name != dns.Fqdn(test.domain) {
+					t.Errorf("answer name = %s", rr.Header().Name)
+				}
+				// The lowest TTL of the upstream answer applies to every address
+				if rr.Header().Ttl > test.maxTTL {
+					t.Errorf("ttl = %d, want at most %d", rr.Header().Ttl, test.maxTTL)
+				}
+			}
+			if count := u.count(test.target); count != test.queries {
+				t.Errorf("upstream queries = %d, want %d", count, test.queries)
+			}
+		})
+	}
+}
+
+func TestAliasUnreachableUpstream(t *testing.T) {
+	storage := newStorage(t, map[string]string{"example.com": "target.example.net."})
+	// A closed port stands in for an unreachable resolver
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Upstream = conn.LocalAddr().String()
+	conn.Close()
+
+	m := query(storage, "example.com", dns.TypeA)
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if len(m.Answer) != 0 || len(m.Ns) != 0 {
+		t.Errorf("answer = %v, authority = %v", m.Answer, m.Ns)
+	}
+}
+
+func TestReverseZone(t *testing.T) {
+	storage := newStorage(t, nil)
+	if err := storage.DB.NewUser(models.User{Username: "alice", Password: "secret", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DB.VerifyUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	zones := []models.ReverseZone{
+		{Owner: "alice", Prefix: "192.0.2.0/24", AutoPTR: true, Approved: true},
+		{Owner: "alice", Prefix: "2001:db8::/32", AutoPTR: true, Approved: true},
+		{Owner: "alice", Prefix: "198.51.100.0/24", AutoPTR: true},
+	}
+	for _, zone := range zones {
+		if err := storage.DB.NewReverseZone(zone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	services := []models.ServiceEntry{
+		{Owner: "alice", Subdomain: "www", DNSRecordType: "A", Destination: "192.0.2.10"},
+		{Owner: "alice", Subdomain: "v6", DNSRecordType: "AAAA", Destination: "2001:DB8:0:0::10"},
+	}
+	for _, service := range services {
+		if errs := service.Normalize(); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		tx, _, err := storage.DB.NewService(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v6, _ := dns.ReverseAddr("2001:db8::10")
+
+	tests := []struct {
+		name    string
+		qName   string
+		qType   uint16
+		rcode   int
+		answers int
+		// soa is set when the authority section should hold the SOA of the zone
+		soa bool
+	}{
+		{"apex soa", "2.0.192.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"apex ns", "2.0.192.in-addr.arpa.", dns.TypeNS, dns.RcodeSuccess, 2, false},
+		{"ipv6 apex soa", "8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"automatic ptr", "10.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, 1, false},
+		{"automatic ptr of a non-canonical ipv6 address", v6, dns.TypePTR, dns.RcodeSuccess, 1, false},
+		{"unknown address", "11.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, 0, true},
+		{"apex without ptr", "2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, 0, true},
+		{"unapproved prefix", "100.51.198.in-addr.arpa.", dns.TypeSOA, dns.RcodeNameError, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := query(storage, test.qName, test.qType)
+			if m.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if len(m.Answer) != test.answers {
+				t.Fatalf("answers = %v, want %d", m.Answer, test.answers)
+			}
+			for _, rr := range m.Answer {
+				if rr.Header().Name != test.qName {
+					t.Errorf("answer name = %s", rr.Header().Name)
+				}
+			}
+			if soa := len(m.Ns) == 1 && m.Ns[0].Header().Rrtype == dns.TypeSOA; soa != test.soa {
+				t.Errorf("authority = %v", m.Ns)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package ipdetect
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/database"
+)
+
+// Detector finds the current public addresses of this host.
+// A nil list means the address family could not be detected and should be left alone.
+type Detector interface {
+	Detect() (ipv4 []string, ipv6 []string, err error)
+}
+
+// InterfaceDetector uses the global unicast addresses assigned to local interfaces
+type InterfaceDetector struct{}
+
+func (InterfaceDetector) Detect() ([]string, []string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Families without a public address stay nil, behind NAT the configured addresses are kept
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip.String())
+		} else {
+			ipv6 = append(ipv6, ip.String())
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// HTTPDetector asks an echo endpoint which returns the caller's address as plain text
+type HTTPDetector struct {
+	URLv4  string
+	URLv6  string
+	Client *http.Client
+}
+
+func NewHTTPDetector(urlv4, urlv6 string) *HTTPDetector {
+	return &HTTPDetector{
+		URLv4:  urlv4,
+		URLv6:  urlv6,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (d *HTTPDetector) Detect() ([]string, []string, error) {
+	var ipv4, ipv6 []string
+	var errs []string
+	if d.URLv4 != "" {
+		ip, err := d.fetch(d.URLv4)
+		if err == nil && ip.To4() == nil {
+			err = fmt.Errorf("%s returned non IPv4 address %s", d.URLv4, ip)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			ipv4 = []string{ip.String()}
+		}
+	}
+	if d.URLv6 != "" {
+		ip, err := d.fetch(d.URLv6)
+		if err == nil && ip.To4() != nil {
+			err = fmt.Errorf("%s returned non IPv6 address %s", d.URLv6, ip)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			ipv6 = []string{ip.String()}
+		}
+	}
+	if ipv4 == nil && ipv6 == nil && len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return ipv4, ipv6, nil
+}
+
+func (d *HTTPDetector) fetch(url string) (net.IP, error) {
+	resp, err := d.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned status code %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned invalid address %q", url, string(body))
+	}
+	return ip, nil
+}
+
+// Watch polls the detector and re-points forwarded services whenever the public address changes
+func Watch(storage *database.Storage, detector Detector, interval time.Duration) {
+	for {
+		ipv4, ipv6, err := detector.Detect()
+		if err != nil {
+			log.Printf("Failed to detect public IP: %s\n", err.Error())
+		} else {
+			storage.SetPublicIPs(ipv4, ipv6)
+		}
+		time.Sleep(interval)
+	}
+}
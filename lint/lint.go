@@ -0,0 +1,228 @@
+package lint
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// Warning is a single problem found in a zone
+type Warning struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Name     string `json:"name"`
+	Message  string `json:"message"`
+}
+
+type Options struct {
+	// DialTimeout enables reachability checks of forwarding upstreams when non zero
+	DialTimeout time.Duration
+	// Settings enable the TTL checks, records are all served with the zone's default TTL
+	Settings *models.ZoneSettings
+}
+
+// TTL bounds outside of which a zone's TTLs are reported
+const (
+	minTTL         = 30
+	maxTTL         = 86400
+	maxForwardTTL  = 3600
+	maxNegativeTTL = 10800
+)
+
+// Zone analyzes the records of domain and reports problems.
+func Zone(domain string, records []models.ServiceEntry, opts Options) []Warning {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	warnings := make([]Warning, 0)
+	byName := make(map[string][]models.ServiceEntry)
+	for _, record := range records {
+		byName[record.Subdomain] = append(byName[record.Subdomain], record)
+	}
+
+	for subdomain, entries := range byName {
+		name := displayName(subdomain, domain)
+		hasCNAME, hasOther := false, false
+		seen := make(map[string]bool)
+		for _, entry := range entries {
+			if !entry.Forwarding && entry.DNSRecordType == "CNAME" {
+				hasCNAME = true
+			} else {
+				hasOther = true
+			}
+			if entry.Forwarding {
+				continue
+			}
+			key := entry.DNSRecordType + " " + canonicalRdata(entry)
+			if seen[key] {
+				warnings = append(warnings, Warning{"duplicate", SeverityWarning, name, fmt.Sprintf("Duplicate %s record %s", entry.DNSRecordType, entry.Destination)})
+			}
+			seen[key] = true
+		}
+		if hasCNAME && (hasOther || countCNAME(entries) > 1) {
+			warnings = append(warnings, Warning{"cname_conflict", SeverityError, name, "CNAME cannot coexist with other records at the same name"})
+		}
+		if hasCNAME && subdomain == "" {
+			warnings = append(warnings, Warning{"cname_apex", SeverityError, name, "CNAME is not allowed at the zone apex, use ALIAS instead"})
+		}
+
+		for _, entry := range entries {
+			if entry.Forwarding {
+				if opts.DialTimeout > 0 {
+					warnings = append(warnings, CheckUpstreams(name, entry, opts.DialTimeout)...)
+				}
+				continue
+			}
+			target := targetOf(entry)
+			if target == "" {
+				continue
+			}
+			if target != domain && !strings.HasSuffix(target, "."+domain) {
+				continue
+			}
+			targetSubdomain := strings.TrimSuffix(strings.TrimSuffix(target, domain), ".")
+			if _, ok := byName[targetSubdomain]; !ok {
+				warnings = append(warnings, Warning{"dangling_target", SeverityWarning, name, fmt.Sprintf("%s target %s has no records in this zone", entry.DNSRecordType, target)})
+			}
+		}
+	}
+
+	if opts.Settings != nil {
+		warnings = append(warnings, checkTTLs(domain, records, *opts.Settings)...)
+	}
+	if !hasTXT(byName[""], "v=spf1") {
+		warnings = append(warnings, Warning{"missing_spf", SeverityInfo, domain, "No SPF record, add \"v=spf1 -all\" if the domain sends no mail"})
+	}
+	if !hasTXT(byName["_dmarc"], "v=DMARC1") {
+		warnings = append(warnings, Warning{"missing_dmarc", SeverityInfo, "_dmarc." + domain, "No DMARC record"})
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Name < warnings[j].Name
+	})
+	return warnings
+}
+
+// checkTTLs reports TTLs far outside of what resolvers and the proxy's re-pointing expect
+func checkTTLs(domain string, records []models.ServiceEntry, settings models.ZoneSettings) []Warning {
+	warnings := make([]Warning, 0)
+	ttl := settings.DefaultTTL
+	switch {
+	case ttl < minTTL:
+		warnings = append(warnings, Warning{"ttl_outlier", SeverityWarning, domain, fmt.Sprintf("Default TTL of %ds is below %ds, resolvers will query the zone constantly", ttl, minTTL)})
+	case ttl > maxTTL:
+		warnings = append(warnings, Warning{"ttl_outlier", SeverityWarning, domain, fmt.Sprintf("Default TTL of %ds is above %ds, changes take that long to reach every resolver", ttl, maxTTL)})
+	case ttl > maxForwardTTL:
+		for _, record := range records {
+			if record.Forwarding {
+				warnings = append(warnings, Warning{"ttl_outlier", SeverityInfo, domain, fmt.Sprintf("Default TTL of %ds delays forwarded names following a new proxy address by up to that long", ttl)})
+				break
+			}
+		}
+	}
+	// Negative answers are cached for the lower of the default TTL and the SOA minimum
+	if settings.Minimum > maxNegativeTTL && ttl > maxNegativeTTL {
+		negative := settings.Minimum
+		if ttl < negative {
+			negative = ttl
+		}
+		warnings = append(warnings, Warning{"ttl_outlier", SeverityInfo, domain, fmt.Sprintf("Negative answers are cached for %ds, new names stay unresolvable that long for resolvers that queried them before", negative)})
+	}
+	return warnings
+}
+
+// CheckUpstreams dials every upstream of a forwarding service and of its rules at once
+func CheckUpstreams(name string, entry models.ServiceEntry, timeout time.Duration) []Warning {
+	upstreams := append([]models.Upstream{}, entry.Backends()...)
+	for _, rule := range entry.Rules {
+		upstreams = append(upstreams, rule.Upstreams...)
+	}
+	failures := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", address, timeout)
+			if err != nil {
+				failures[i] = err
+				return
+			}
+			conn.Close()
+		}(i, dialAddress(upstream))
+	}
+	wg.Wait()
+	warnings := make([]Warning, 0)
+	for i, err := range failures {
+		if err != nil {
+			warnings = append(warnings, Warning{"unreachable_upstream", SeverityWarning, name, fmt.Sprintf("Upstream %s is unreachable: %s", dialAddress(upstreams[i]), err.Error())})
+		}
+	}
+	return warnings
+}
+
+func dialAddress(upstream models.Upstream) string {
+	host, _ := models.SplitScheme(upstream.Address)
+	return host
+}
+
+func displayName(subdomain, domain string) string {
+	if subdomain == "" {
+		return domain
+	}
+	return subdomain + "." + domain
+}
+
+func countCNAME(entries []models.ServiceEntry) int {
+	count := 0
+	for _, entry := range entries {
+		if !entry.Forwarding && entry.DNSRecordType == "CNAME" {
+			count++
+		}
+	}
+	return count
+}
+
+func canonicalRdata(entry models.ServiceEntry) string {
+	rr, err := dns.NewRR(fmt.Sprintf("x. 60 IN %s %s", entry.DNSRecordType, entry.Destination))
+	if err != nil || rr == nil {
+		return strings.ToLower(entry.Destination)
+	}
+	return strings.ToLower(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// targetOf returns the hostname a CNAME, MX or ALIAS record points to
+func targetOf(entry models.ServiceEntry) string {
+	var target string
+	switch entry.DNSRecordType {
+	case "CNAME", "ALIAS":
+		target = entry.Destination
+	case "MX":
+		fields := strings.Fields(entry.Destination)
+		if len(fields) != 2 {
+			return ""
+		}
+		target = fields[1]
+	default:
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(target, "."))
+}
+
+func hasTXT(entries []models.ServiceEntry, prefix string) bool {
+	for _, entry := range entries {
+		if entry.DNSRecordType == "TXT" && strings.HasPrefix(strings.Trim(entry.Destination, "\""), prefix) {
+			return true
+		}
+	}
+	return false
+}
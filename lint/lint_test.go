@@ -0,0 +1,176 @@
+package lint
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+// mail holds the SPF and DMARC records so only the records under test produce warnings
+var mail = []models.ServiceEntry{
+	{Subdomain: "", DNSRecordType: "TXT", Destination: "\"v=spf1 -all\""},
+	{Subdomain: "_dmarc", DNSRecordType: "TXT", Destination: "\"v=DMARC1; p=reject\""},
+}
+
+func TestZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  []models.ServiceEntry
+		settings *models.ZoneSettings
+		noMail   bool
+		codes    []string
+	}{
+		{
+			name: "clean",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "A", Destination: "192.0.2.1"},
+				{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.com."},
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+				{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.2"},
+			},
+		},
+		{
+			name:   "missing spf and dmarc",
+			noMail: true,
+			codes:  []string{"missing_dmarc", "missing_spf"},
+		},
+		{
+			name: "duplicate",
+			records: []models.ServiceEntry{
+				{Subdomain: "www", DNSRecordType: "AAAA", Destination: "2001:db8::1"},
+				{Subdomain: "www", DNSRecordType: "AAAA", Destination: "2001:0db8::0001"},
+			},
+			codes: []string{"duplicate"},
+		},
+		{
+			name: "cname next to other records",
+			records: []models.ServiceEntry{
+				{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.net."},
+				{Subdomain: "www", DNSRecordType: "TXT", Destination: "\"x\""},
+			},
+			codes: []string{"cname_conflict"},
+		},
+		{
+			name: "cname next to a forwarded service",
+			records: []models.ServiceEntry{
+				{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.net."},
+				{Subdomain: "www", Destination: "10.0.0.1", Port: 80, Forwarding: true},
+			},
+			codes: []string{"cname_conflict"},
+		},
+		{
+			name: "cname at apex",
+			records: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "CNAME", Destination: "example.net."},
+			},
+			codes: []string{"cname_apex", "cname_conflict"},
+		},
+		{
+			name: "dangling targets",
+			records: []models.ServiceEntry{
+				{Subdomain: "www", DNSRecordType: "CNAME", Destination: "missing.example.com."},
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mx.example.com."},
+				{Subdomain: "other", DNSRecordType: "CNAME", Destination: "missing.example.net."},
+			},
+			codes: []string{"dangling_target", "dangling_target"},
+		},
+		{
+			name:     "usual ttls",
+			records:  []models.ServiceEntry{{Subdomain: "www", Destination: "10.0.0.1", Port: 80, Forwarding: true}},
+			settings: &models.ZoneSettings{DefaultTTL: 300, Minimum: 3600},
+		},
+		{
+			name:     "ttl too low",
+			settings: &models.ZoneSettings{DefaultTTL: 5, Minimum: 3600},
+			codes:    []string{"ttl_outlier"},
+		},
+		{
+			name:     "ttl too high",
+			settings: &models.ZoneSettings{DefaultTTL: 604800, Minimum: 3600},
+			codes:    []string{"ttl_outlier"},
+		},
+		{
+			name:     "long ttl with forwarded services",
+			records:  []models.ServiceEntry{{Subdomain: "www", Destination: "10.0.0.1", Port: 80, Forwarding: true}},
+			settings: &models.ZoneSettings{DefaultTTL: 7200, Minimum: 3600},
+			codes:    []string{"ttl_outlier"},
+		},
+		{
+			name:     "long ttl without forwarded services",
+			settings: &models.ZoneSettings{DefaultTTL: 7200, Minimum: 3600},
+		},
+		{
+			name:     "long negative caching",
+			settings: &models.ZoneSettings{DefaultTTL: 86400, Minimum: 86400},
+			codes:    []string{"ttl_outlier"},
+		},
+		{
+			name:     "negative caching capped by the default ttl",
+			settings: &models.ZoneSettings{DefaultTTL: 3600, Minimum: 86400},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := test.records
+			if !test.noMail {
+				records = append(append([]models.ServiceEntry{}, mail...), records...)
+			}
+			codes := make([]string, 0)
+			for _, warning := range Zone("example.com", records, Options{Settings: test.settings}) {
+				codes = append(codes, warning.Code)
+			}
+			sort.Strings(codes)
+			want := append([]string{}, test.codes...)
+			if !reflect.DeepEqual(codes, want) {
+				t.Errorf("codes = %v, want %v", codes, want)
+			}
+		})
+	}
+}
+
+func TestCheckUpstreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// A closed listener leaves a port that refuses connections
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+	up := listener.Addr().String()
+
+	tests := []struct {
+		name     string
+		entry    models.ServiceEntry
+		failures int
+	}{
+		{"reachable", models.ServiceEntry{Forwarding: true, LoadBalancing: models.LoadBalancing{Upstreams: []models.Upstream{{Address: up}}}}, 0},
+		{"unreachable", models.ServiceEntry{Forwarding: true, LoadBalancing: models.LoadBalancing{Upstreams: []models.Upstream{{Address: up}, {Address: "http://" + down}}}}, 1},
+		{"rule upstreams are dialed", models.ServiceEntry{Forwarding: true,
+			LoadBalancing: models.LoadBalancing{Upstreams: []models.Upstream{{Address: up}}},
+			Rules:         models.RouteRules{{Paths: []string{"/api/*"}, Upstreams: []models.Upstream{{Address: down}}}},
+		}, 1},
+		{"static responses have no upstreams", models.ServiceEntry{Forwarding: true, Response: models.StaticResponse{Type: models.ResponseStatic}}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			warnings := CheckUpstreams("example.com", test.entry, time.Second)
+			if len(warnings) != test.failures {
+				t.Errorf("warnings = %+v, want %d", warnings, test.failures)
+			}
+			for _, warning := range warnings {
+				if warning.Code != "unreachable_upstream" {
+					t.Errorf("code = %s", warning.Code)
+				}
+			}
+		})
+	}
+}
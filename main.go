@@ -5,10 +5,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/acheong08/nameserver/api"
+	"github.com/acheong08/nameserver/caddy"
 	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/dnsserver"
+	"github.com/acheong08/nameserver/ipdetect"
 	"github.com/acheong08/nameserver/models"
+	"github.com/acheong08/nameserver/outbox"
+	"github.com/acheong08/nameserver/reconciler"
+	"github.com/acheong08/nameserver/verifier"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/miekg/dns"
@@ -20,44 +28,69 @@ var staticEmbed embed.FS
 func main() {
 	dnsAddr := flag.String("dns-addr", ":5553", "DNS listen address")
 	httpAddr := flag.String("http-addr", ":8080", "HTTP listen address")
-	publicIP := flag.String("public-ip", "127.0.0.1", "Public IP address")
+	publicIP := flag.String("public-ip", "127.0.0.1", "Public IPv4 addresses of the reverse proxy (comma separated)")
+	publicIPv6 := flag.String("public-ipv6", "", "Public IPv6 addresses of the reverse proxy (comma separated)")
+	detectIP := flag.String("detect-ip", "", "Detect the public IP automatically using \"interface\" or \"http\"")
+	detectURL := flag.String("detect-url", "https://api.ipify.org", "Echo endpoint returning the public IPv4 address")
+	detectURLv6 := flag.String("detect-url-ipv6", "https://api6.ipify.org", "Echo endpoint returning the public IPv6 address")
+	detectInterval := flag.Duration("detect-interval", 5*time.Minute, "Interval between public IP checks")
+	nameservers := flag.String("nameservers", "", "Hostnames of this nameserver (comma separated, defaults to ns1/ns2 of each domain)")
+	upstream := flag.String("upstream", "1.1.1.1:53", "Upstream resolver used to flatten ALIAS records and verify domains")
+	verifyInterval := flag.Duration("verify-interval", 5*time.Minute, "Interval between domain ownership checks")
+	caddyURL := flag.String("caddy-url", "http://127.0.0.1:2019", "Caddy admin API address")
+	caddySocket := flag.String("caddy-socket", "", "Caddy admin API Unix socket, used instead of -caddy-url")
+	caddyCert := flag.String("caddy-cert", "", "Client certificate for Caddy's remote admin API")
+	caddyKey := flag.String("caddy-key", "", "Client key for Caddy's remote admin API")
+	caddyCA := flag.String("caddy-ca", "", "CA certificate verifying Caddy's remote admin API")
+	caddyServer := flag.String("caddy-server", "srv0", "Name of the Caddy HTTP server holding the routes")
+	caddyTimeout := flag.Duration("caddy-timeout", 10*time.Second, "Timeout of Caddy admin API requests")
+	wafLog := flag.String("waf-log", "", "Caddy's JSON log file holding the WAF matches")
+	reconcileInterval := flag.Duration("reconcile-interval", 5*time.Minute, "Interval between repairs of drift between the database and Caddy's routes")
+	trustedProxies := flag.String("trusted-proxies", "", "Addresses or CIDRs of reverse proxies in front of the API whose X-Forwarded-For is trusted (comma separated)")
+	admins := flag.String("admins", "", "Usernames allowed to approve reverse zones and reconcile Caddy (comma separated)")
 	debug := flag.Bool("debug", false, "Debug mode")
 	flag.Parse()
 
-	storage, err := database.NewStorage(*publicIP)
+	storage, err := database.NewStorage(splitList(*publicIP), splitList(*publicIPv6))
 	if err != nil {
 		panic(fmt.Errorf("Failed to start storage: %s\n", err.Error()))
 	}
 	defer storage.DB.Close()
+	storage.Upstream = *upstream
+	storage.Nameservers = splitList(*nameservers)
+	api.WAFLog = *wafLog
+	api.Admins = splitList(*admins)
+
+	proxy, err := caddy.NewClient(caddy.ClientConfig{
+		BaseURL:  *caddyURL,
+		Socket:   *caddySocket,
+		CertFile: *caddyCert,
+		KeyFile:  *caddyKey,
+		CAFile:   *caddyCA,
+		Server:   *caddyServer,
+		Timeout:  *caddyTimeout,
+	})
+	if err != nil {
+		panic(fmt.Errorf("Failed to configure Caddy client: %s\n", err.Error()))
+	}
+
+	go verifier.Watch(storage, *verifyInterval)
+	go outbox.Watch(storage, proxy, 5*time.Second)
+	go reconciler.Watch(storage, proxy, *reconcileInterval)
+
+	switch *detectIP {
+	case "":
+	case "interface":
+		go ipdetect.Watch(storage, ipdetect.InterfaceDetector{}, *detectInterval)
+	case "http":
+		go ipdetect.Watch(storage, ipdetect.NewHTTPDetector(*detectURL, *detectURLv6), *detectInterval)
+	default:
+		panic(fmt.Errorf("Unknown IP detection method: %s\n", *detectIP))
+	}
 
 	go func(dnsAddr *string, storage *database.Storage) {
 		server := &dns.Server{Addr: *dnsAddr, Net: "udp", ReusePort: true, TsigSecret: nil}
-		server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
-			m := new(dns.Msg)
-			m.SetReply(r)
-			m.Authoritative = true
-			m.RecursionAvailable = true
-
-			qType := dns.TypeToString[r.Question[0].Qtype]
-			qName := r.Question[0].Name
-			dnsRecords := storage.GetDNS(qName)
-			if dnsRecords == nil {
-				m.SetRcode(r, dns.RcodeNameError)
-				w.WriteMsg(m)
-				return
-			}
-			for _, dnsRecord := range dnsRecords {
-				if dnsRecord.RecordType == qType || dnsRecord.RecordType == "CNAME" {
-					rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", qName, 60, dnsRecord.RecordType, dnsRecord.Dest))
-					if err != nil {
-						fmt.Println(fmt.Errorf("Failed to create RR: %s\n", err.Error()))
-						continue
-					}
-					m.Answer = append(m.Answer, rr)
-				}
-			}
-			w.WriteMsg(m)
-		})
+		server.Handler = dnsserver.NewHandler(storage)
 		err := server.ListenAndServe()
 		if err != nil {
 			panic(fmt.Errorf("Failed to start DNS server: %s\n", err.Error()))
@@ -65,9 +98,14 @@ func main() {
 	}(dnsAddr, storage)
 
 	router := gin.Default()
+	// Client addresses are checked against ACME allowfrom lists, so forwarded headers are only trusted from known proxies
+	if err := router.SetTrustedProxies(splitList(*trustedProxies)); err != nil {
+		panic(fmt.Errorf("Invalid trusted proxies: %s\n", err.Error()))
+	}
 	router.Use(func(c *gin.Context) {
-		// Add storage to context
+		// Add storage and the Caddy client to context
 		c.Set("storage", storage)
+		c.Set("caddy", proxy)
 	})
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(200, "pong")
@@ -115,6 +153,12 @@ func main() {
 		index, _ := staticEmbed.ReadFile("static/htmj.js")
 		ctx.Data(200, "text/javascript", index)
 	})
+	// acme-dns compatible API, clients should use /acme as their server URL.
+	// Accounts are registered at /api/acme/register by a logged in user rather than at /acme/register.
+	router.POST("/acme/update", api.ACMEUpdate)
+	router.GET("/acme/health", func(c *gin.Context) {
+		c.Status(200)
+	})
 	authNeeded := router.Group("/api")
 	if !*debug {
 		authNeeded.Use(api.AuthMiddleware)
@@ -127,6 +171,11 @@ func main() {
 		if err != nil {
 			log.Println(err)
 		}
+		err = storage.DB.VerifyUser("admin")
+		if err != nil {
+			log.Println(err)
+		}
+		api.Admins = append(api.Admins, "admin")
 		authNeeded.Use(func(c *gin.Context) {
 			// Set user to admin
 			c.Set("user", models.User{
@@ -140,8 +189,56 @@ func main() {
 	authNeeded.DELETE("/service", api.ServiceEntry)
 	authNeeded.PATCH("/service", api.ServiceEntry)
 
+	authNeeded.GET("/reverse", api.ReverseZone)
+	authNeeded.POST("/reverse", api.ReverseZone)
+	authNeeded.DELETE("/reverse", api.ReverseZone)
+
+	authNeeded.GET("/reverse/approve", api.AdminMiddleware, api.ApproveReverseZone)
+	authNeeded.POST("/reverse/approve", api.AdminMiddleware, api.ApproveReverseZone)
+	authNeeded.DELETE("/reverse/approve", api.AdminMiddleware, api.ApproveReverseZone)
+
+	authNeeded.GET("/reverse/ptr", api.PTRRecord)
+	authNeeded.POST("/reverse/ptr", api.PTRRecord)
+	authNeeded.DELETE("/reverse/ptr", api.PTRRecord)
+
+	authNeeded.POST("/zone/import", api.ImportZone)
+	authNeeded.POST("/zone/import/cloudflare", api.ImportCloudflare)
+	authNeeded.GET("/zone/export", api.ExportZone)
+	authNeeded.GET("/zone/lint", api.LintZone)
+	authNeeded.GET("/zone/settings", api.ZoneSettings)
+	authNeeded.PATCH("/zone/settings", api.ZoneSettings)
+
+	authNeeded.POST("/acme/register", api.ACMERegister)
+	authNeeded.GET("/acme", api.ACMEAccounts)
+	authNeeded.DELETE("/acme", api.ACMEAccounts)
+
+	authNeeded.GET("/verification", api.Verification)
+	authNeeded.POST("/verification", api.Verification)
+
+	authNeeded.POST("/caddy/reconcile", api.AdminMiddleware, api.Reconcile)
+	authNeeded.GET("/waf/hits", api.WAFHits)
+
+	authNeeded.GET("/history", api.History)
+	authNeeded.GET("/history/diff", api.HistoryDiff)
+	authNeeded.POST("/history/rollback", api.Rollback)
+
+	authNeeded.GET("/debug/resolve", api.DebugResolve)
+
 	authNeeded.POST("/cache/clear", api.ClearCache)
+	authNeeded.GET("/events", api.Events)
 
 	router.Run(*httpAddr)
 
 }
+
+// splitList splits a comma separated flag value, ignoring empty entries
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
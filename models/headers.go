@@ -0,0 +1,119 @@
+package models
+
+import (
+	"database/sql/driver"
+	"sort"
+	"strings"
+)
+
+// HeaderPresets are response headers added with one switch, explicit rules override their values
+var HeaderPresets = map[string]map[string]string{
+	"hsts": {
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	},
+	"csp": {
+		"Content-Security-Policy": "default-src 'self'; frame-ancestors 'self'; object-src 'none'",
+	},
+	"frame_options": {
+		"X-Frame-Options": "DENY",
+	},
+	"referrer_policy": {
+		"Referrer-Policy": "strict-origin-when-cross-origin",
+	},
+	"cors": {
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		"Access-Control-Allow-Headers": "*",
+	},
+}
+
+// HeaderOps change the headers of a request or response
+type HeaderOps struct {
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+	Delete []string          `json:"delete"`
+}
+
+// Empty reports whether the operations change nothing
+func (ops HeaderOps) Empty() bool {
+	return len(ops.Set) == 0 && len(ops.Add) == 0 && len(ops.Delete) == 0
+}
+
+// HeaderRules change the headers of requests sent to the upstream and of responses sent to clients
+type HeaderRules struct {
+	Request  HeaderOps `json:"request"`
+	Response HeaderOps `json:"response"`
+	// Presets are names from HeaderPresets
+	Presets []string `json:"presets"`
+}
+
+// Value stores the rules as JSON
+func (h HeaderRules) Value() (driver.Value, error) {
+	return jsonValue(h)
+}
+
+// Scan reads rules stored as JSON
+func (h *HeaderRules) Scan(src interface{}) error {
+	return scanJSON(src, h)
+}
+
+// ResponseOps merges the presets with the explicit response rules
+func (h HeaderRules) ResponseOps() HeaderOps {
+	ops := HeaderOps{
+		Set:    make(map[string]string),
+		Add:    h.Response.Add,
+		Delete: h.Response.Delete,
+	}
+	for _, preset := range h.Presets {
+		for name, value := range HeaderPresets[preset] {
+			ops.Set[name] = value
+		}
+	}
+	for name, value := range h.Response.Set {
+		ops.Set[name] = value
+	}
+	return ops
+}
+
+func (h HeaderRules) validate() []FieldError {
+	errs := make([]FieldError, 0)
+	errs = append(errs, h.Request.validate("headers.request")...)
+	errs = append(errs, h.Response.validate("headers.response")...)
+	for _, preset := range h.Presets {
+		if _, ok := HeaderPresets[preset]; !ok {
+			names := make([]string, 0, len(HeaderPresets))
+			for name := range HeaderPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			errs = append(errs, FieldError{"headers.presets", "Unknown preset " + preset + ", use one of " + strings.Join(names, ", ")})
+		}
+	}
+	return errs
+}
+
+func (ops HeaderOps) validate(field string) []FieldError {
+	errs := make([]FieldError, 0)
+	names := make([]string, 0, len(ops.Set)+len(ops.Add)+len(ops.Delete))
+	for name := range ops.Set {
+		names = append(names, name)
+	}
+	for name := range ops.Add {
+		names = append(names, name)
+	}
+	names = append(names, ops.Delete...)
+	sort.Strings(names)
+	for _, name := range names {
+		if !isHeaderName(name) {
+			errs = append(errs, FieldError{field, "Invalid header name " + name})
+		}
+	}
+	for _, values := range []map[string]string{ops.Set, ops.Add} {
+		for name, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				errs = append(errs, FieldError{field, "Value of header " + name + " cannot contain line breaks"})
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile maps names per UTS 46 but still allows underscores used by service labels like _dmarc
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// ToASCII normalizes a U-label or A-label name to lower case punycode for storage, DNS and Caddy
+func ToASCII(name string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(strings.TrimSpace(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// ToUnicode returns the display form of a name, falling back to the name itself
+func ToUnicode(name string) string {
+	unicode, err := idna.Display.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return unicode
+}
+
+// hostnameTypes are record types whose destination is a hostname
+var hostnameTypes = map[string]bool{"CNAME": true, "NS": true, "PTR": true, "ALIAS": true}
+
+// Normalize converts the names of a service entry to punycode
+func (se *ServiceEntry) Normalize() []FieldError {
+	errs := make([]FieldError, 0)
+	subdomain, err := ToASCII(se.Subdomain)
+	if err != nil {
+		errs = append(errs, FieldError{"subdomain", "Invalid internationalized name: " + err.Error()})
+	} else {
+		se.Subdomain = subdomain
+	}
+	if se.Forwarded() {
+		if se.Destination != "" {
+			destination, err := upstreamToASCII(se.Destination)
+			if err != nil {
+				return append(errs, FieldError{"destination", "Invalid internationalized name: " + err.Error()})
+			}
+			se.Destination = destination
+		}
+		for i, upstream := range se.LoadBalancing.Upstreams {
+			address, err := upstreamToASCII(upstream.Address)
+			if err != nil {
+				return append(errs, FieldError{"load_balancing.upstreams", "Invalid internationalized name: " + err.Error()})
+			}
+			se.LoadBalancing.Upstreams[i].Address = address
+		}
+		return errs
+	}
+	switch {
+	case se.DNSRecordType == "A" || se.DNSRecordType == "AAAA":
+		// Addresses are stored in their canonical form so automatic PTR answers can match them
+		if ip := net.ParseIP(se.Destination); ip != nil {
+			se.Destination = ip.String()
+		}
+	case hostnameTypes[se.DNSRecordType]:
+		destination, err := hostToASCII(se.Destination)
+		if err != nil {
+			return append(errs, FieldError{"destination", "Invalid internationalized name: " + err.Error()})
+		}
+		se.Destination = destination
+	case se.DNSRecordType == "MX":
+		// The mail server follows the preference
+		fields := strings.Fields(se.Destination)
+		if len(fields) != 2 {
+			return errs
+		}
+		exchange, err := hostToASCII(fields[1])
+		if err != nil {
+			return append(errs, FieldError{"destination", "Invalid internationalized name: " + err.Error()})
+		}
+		se.Destination = fields[0] + " " + exchange
+	}
+	return errs
+}
+
+// Normalize converts the hostname of a PTR record to punycode and checks it
+func (r *PTRRecord) Normalize() error {
+	hostname, err := hostToASCII(r.Hostname)
+	if err != nil {
+		return fmt.Errorf("Invalid internationalized name: %s", err.Error())
+	}
+	if !isHostname(hostname) {
+		return fmt.Errorf("PTR records need a fully qualified domain name")
+	}
+	r.Hostname = hostname
+	return nil
+}
+
+// hostToASCII converts a hostname to punycode, keeping a trailing dot
+func hostToASCII(host string) (string, error) {
+	trailingDot := strings.HasSuffix(host, ".")
+	ascii, err := ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", err
+	}
+	if trailingDot {
+		ascii += "."
+	}
+	return ascii, nil
+}
+
+// upstreamToASCII converts the host of a destination or upstream to punycode, keeping its scheme and port
+func upstreamToASCII(address string) (string, error) {
+	scheme := ""
+	for _, prefix := range []string{"https://", "http://"} {
+		if strings.HasPrefix(address, prefix) {
+			scheme = prefix
+		}
+	}
+	host := strings.TrimPrefix(address, scheme)
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	// IP addresses are left alone
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ascii, err := hostToASCII(host)
+	if err != nil {
+		return "", err
+	}
+	if port != "" {
+		ascii = net.JoinHostPort(ascii, port)
+	}
+	return scheme + ascii, nil
+}
+
+// Display converts the names of a service entry to their Unicode form
+func (se *ServiceEntry) Display() {
+	se.Subdomain = ToUnicode(se.Subdomain)
+	se.Domain = ToUnicode(se.Domain)
+	if hostnameTypes[se.DNSRecordType] {
+		se.Destination = ToUnicode(se.Destination)
+	}
+	if se.DNSRecordType == "MX" && !se.Forwarding {
+		if fields := strings.Fields(se.Destination); len(fields) == 2 {
+			se.Destination = fields[0] + " " + ToUnicode(fields[1])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies are the upstream selection policies of Caddy's reverse proxy
+var Policies = []string{"round_robin", "least_conn", "ip_hash", "cookie"}
+
+// Upstream is a backend of a forwarded service
+type Upstream struct {
+	// Address is host:port, prefixed with https:// to connect over TLS or optionally with http://.
+	// Port 443 uses TLS unless http:// is given.
+	Address string `json:"address"`
+	// Weight only applies to the round_robin policy, 0 counts as 1
+	Weight int `json:"weight"`
+}
+
+// LoadBalancing spreads a forwarded service over several upstreams
+type LoadBalancing struct {
+	// Upstreams replace Destination and Port when set
+	Upstreams []Upstream `json:"upstreams"`
+	Policy    string     `json:"policy"`
+	// Active health checks are enabled by setting a path
+	HealthPath     string `json:"health_path"`
+	HealthInterval string `json:"health_interval"`
+	HealthStatus   int    `json:"health_status"`
+	// Passive health checks mark an upstream down after MaxFails failed requests within FailDuration
+	MaxFails     int    `json:"max_fails"`
+	FailDuration string `json:"fail_duration"`
+}
+
+// Value stores the settings as JSON
+func (lb LoadBalancing) Value() (driver.Value, error) {
+	return jsonValue(lb)
+}
+
+// Scan reads settings stored as JSON
+func (lb *LoadBalancing) Scan(src interface{}) error {
+	return scanJSON(src, lb)
+}
+
+// SplitScheme removes an http:// or https:// prefix from a destination or upstream address.
+// https is set when the prefix asks for TLS.
+func SplitScheme(address string) (host string, https bool) {
+	if strings.HasPrefix(address, "https://") {
+		return strings.TrimPrefix(address, "https://"), true
+	}
+	return strings.TrimPrefix(address, "http://"), false
+}
+
+// UsesTLS reports whether an upstream is dialed over TLS, which is the case for https:// and for port 443 without a scheme
+func UsesTLS(address string) bool {
+	host, https := SplitScheme(address)
+	return https || (!strings.HasPrefix(address, "http://") && strings.HasSuffix(host, ":443"))
+}
+
+// Backends returns the upstreams of a forwarded service, which is Destination and Port unless a list is set.
+// Services answering with a static response have none.
+func (se *ServiceEntry) Backends() []Upstream {
+	if se.Response.Type != "" {
+		return nil
+	}
+	if len(se.LoadBalancing.Upstreams) > 0 {
+		return se.LoadBalancing.Upstreams
+	}
+	host, _ := SplitScheme(se.Destination)
+	// The scheme is kept so UsesTLS sees it
+	scheme := strings.TrimSuffix(se.Destination, host)
+	return []Upstream{{Address: scheme + net.JoinHostPort(host, strconv.Itoa(se.Port)), Weight: 1}}
+}
+
+func (lb LoadBalancing) validate() []FieldError {
+	errs := validateUpstreams("load_balancing.upstreams", lb.Upstreams, lb.Policy)
+	if lb.Policy != "" {
+		known := false
+		for _, policy := range Policies {
+			known = known || lb.Policy == policy
+		}
+		if !known {
+			errs = append(errs, FieldError{"load_balancing.policy", "Policy must be one of " + strings.Join(Policies, ", ")})
+		}
+	}
+	if lb.HealthPath != "" && !strings.HasPrefix(lb.HealthPath, "/") {
+		errs = append(errs, FieldError{"load_balancing.health_path", "Health check path must start with /"})
+	}
+	if lb.HealthStatus != 0 && (lb.HealthStatus < 100 || lb.HealthStatus > 599) {
+		errs = append(errs, FieldError{"load_balancing.health_status", "Expected status must be between 100 and 599"})
+	}
+	if lb.MaxFails < 0 {
+		errs = append(errs, FieldError{"load_balancing.max_fails", "Max fails cannot be negative"})
+	}
+	errs = append(errs, validateDuration("load_balancing.health_interval", lb.HealthInterval)...)
+	errs = append(errs, validateDuration("load_balancing.fail_duration", lb.FailDuration)...)
+	return errs
+}
+
+// validateUpstreams checks a list of upstreams balanced with policy
+func validateUpstreams(field string, upstreams []Upstream, policy string) []FieldError {
+	errs := make([]FieldError, 0)
+	tls := 0
+	for _, upstream := range upstreams {
+		address, _ := SplitScheme(upstream.Address)
+		if UsesTLS(upstream.Address) {
+			tls++
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			errs = append(errs, FieldError{field, "Upstream " + upstream.Address + " must be host:port"})
+			continue
+		}
+		if net.ParseIP(host) == nil && !isHostname(host) {
+			errs = append(errs, FieldError{field, "Upstream " + upstream.Address + " must be an IP address or hostname"})
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			errs = append(errs, FieldError{field, "Port of upstream " + upstream.Address + " must be between 1 and 65535"})
+		}
+		if upstream.Weight < 0 {
+			errs = append(errs, FieldError{field, "Weight of upstream " + upstream.Address + " cannot be negative"})
+		}
+		if upstream.Weight > 1 && policy != "round_robin" {
+			errs = append(errs, FieldError{field, "Weights need the round_robin policy"})
+		}
+	}
+	// Caddy uses one transport for every upstream of a proxy
+	if tls > 0 && tls < len(upstreams) {
+		errs = append(errs, FieldError{field, "Upstreams cannot mix TLS (https:// or port 443) and plain HTTP, prefix port 443 upstreams with http:// to connect without TLS"})
+	}
+	return errs
+}
+
+func validateDuration(field, duration string) []FieldError {
+	if duration == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+		return []FieldError{{field, fmt.Sprintf("Invalid duration %q", duration)}}
+	}
+	return nil
+}
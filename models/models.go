@@ -1,11 +1,84 @@
 package models
 
-import "github.com/miekg/dns"
+import "time"
 
 type User struct {
 	Username string `json:"username" db:"username"`
 	Password string `json:"password" db:"password"`
 	Domain   string `json:"domain" db:"domain"`
+	// The zone is not served until ownership of the domain is verified
+	Verified          bool   `json:"verified" db:"verified"`
+	VerificationToken string `json:"verification_token,omitempty" db:"verification_token"`
+}
+
+type Event struct {
+	ID        int       `json:"id" db:"id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	Kind      string    `json:"kind" db:"kind"`
+	Message   string    `json:"message" db:"message"`
+	// Owner is empty for events of the whole server, which only admins can see
+	Owner string `json:"owner,omitempty" db:"owner"`
+}
+
+// ReverseZone is an in-addr.arpa or ip6.arpa zone for an allocated prefix
+type ReverseZone struct {
+	ID      int    `json:"id" db:"id"`
+	Owner   string `json:"owner,omitempty" db:"owner"`
+	Prefix  string `json:"prefix" db:"prefix"`
+	AutoPTR bool   `json:"auto_ptr" db:"auto_ptr"`
+	// Zones are only served once an admin approved the allocation
+	Approved bool `json:"approved" db:"approved"`
+}
+
+type PTRRecord struct {
+	ID       int    `json:"id" db:"id"`
+	ZoneID   int    `json:"zone_id" db:"zone_id"`
+	Address  string `json:"address" db:"address"`
+	Hostname string `json:"hostname" db:"hostname"`
+}
+
+// ZoneDiff describes the changes needed to make a zone match an imported zone file
+type ZoneDiff struct {
+	Add     []ServiceEntry `json:"add"`
+	Remove  []ServiceEntry `json:"remove"`
+	Skipped []string       `json:"skipped"`
+}
+
+// ACMEAccount is an acme-dns compatible account allowed to update the DNS-01 challenge of Name
+type ACMEAccount struct {
+	Username  string `json:"username" db:"username"`
+	Password  string `json:"password,omitempty" db:"password"`
+	Subdomain string `json:"subdomain" db:"subdomain"`
+	Owner     string `json:"-" db:"owner"`
+	Name      string `json:"name" db:"name"`
+	// Comma separated list of CIDR ranges allowed to update, empty allows everyone
+	AllowFrom string `json:"-" db:"allow_from"`
+}
+
+// Change is a version in the history of a zone
+type Change struct {
+	Version   int           `json:"version,omitempty"`
+	ServiceID int           `json:"service_id"`
+	Action    string        `json:"action"`
+	Before    *ServiceEntry `json:"before"`
+	After     *ServiceEntry `json:"after"`
+	Actor     string        `json:"actor,omitempty"`
+	CreatedAt time.Time     `json:"created_at,omitempty"`
+}
+
+// ZoneSettings control the synthesized SOA and NS records of a zone.
+// Zero values are replaced by the server defaults when read.
+type ZoneSettings struct {
+	Domain      string   `json:"domain"`
+	DefaultTTL  uint32   `json:"default_ttl"`
+	Refresh     uint32   `json:"refresh"`
+	Retry       uint32   `json:"retry"`
+	Expire      uint32   `json:"expire"`
+	Minimum     uint32   `json:"minimum"`
+	PrimaryNS   string   `json:"primary_ns"`
+	Hostmaster  string   `json:"hostmaster"`
+	Nameservers []string `json:"nameservers"`
+	Serial      uint32   `json:"serial"`
 }
 
 type limitBy int
@@ -17,7 +90,7 @@ const (
 )
 
 type ServiceEntry struct {
-	ID            int     `json:"id" db:"id"`
+	ID int `json:"id" db:"id"`
 	// http://ip:port if forwarding
 	// IP address if not forwarding
 	Owner         string  `json:"owner,omitempty" db:"owner"`
@@ -29,21 +102,29 @@ type ServiceEntry struct {
 	Forwarding    bool    `json:"forwarding" db:"forwarding"`
 	RateLimit     int     `json:"rate_limit" db:"rate_limit"`
 	LimitBy       limitBy `json:"limit_by" db:"limit_by"`
+	// LimitHeader keys the rate limit by a request header instead of the client IP
+	LimitHeader   string        `json:"limit_header" db:"limit_header"`
+	WAF           WAFSettings   `json:"waf" db:"waf"`
+	LoadBalancing LoadBalancing `json:"load_balancing" db:"load_balancing"`
+	Rules         RouteRules    `json:"rules" db:"rules"`
+	// Response answers with a redirect or static response instead of proxying
+	Response StaticResponse `json:"response" db:"response"`
+	Headers  HeaderRules    `json:"headers" db:"headers"`
+	// SyncStatus of the service's Caddy route: pending, applied or failed: <reason>
+	SyncStatus string `json:"sync_status,omitempty" db:"-"`
 }
 
-func (se *ServiceEntry) IsValidFOrPost() bool {
-	// Check if all required fields are set
-	if se.Destination == "" {
-		return false
-	}
-	if !se.Forwarding && se.DNSRecordType == "" {
-		return false
-	}
-	if se.Forwarding && se.Port == 0 {
-		return false
-	}
-	if _, ok := dns.StringToType[se.DNSRecordType]; !ok {
-		return false
-	}
-	return true
+// CaddyOperation is a change to a Caddy route queued in the same transaction as the database change
+type CaddyOperation struct {
+	ID        int `json:"id" db:"id"`
+	ServiceID int `json:"service_id" db:"service_id"`
+	// Operation is update or remove
+	Operation     string    `json:"operation" db:"operation"`
+	Config        string    `json:"config" db:"config"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError     string    `json:"last_error" db:"last_error"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	// Owner orders the operations of services that may share a host
+	Owner string `json:"owner" db:"owner"`
 }
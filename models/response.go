@@ -0,0 +1,90 @@
+package models
+
+import (
+	"database/sql/driver"
+	"net/url"
+	"strings"
+)
+
+const (
+	ResponseRedirect = "redirect"
+	ResponseStatic   = "static"
+)
+
+// StaticResponse makes Caddy answer a forwarded name itself instead of proxying it
+type StaticResponse struct {
+	// Type is redirect or static, empty to proxy to the upstreams
+	Type string `json:"type"`
+	// Location is where redirects point to, e.g. https://example.com
+	Location  string `json:"location"`
+	Permanent bool   `json:"permanent"`
+	// PreservePath appends the requested path and query to Location
+	PreservePath bool `json:"preserve_path"`
+	// Status overrides the status code, redirects default to 301 or 302 and static responses to 200
+	Status  int               `json:"status"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Forwarded reports whether a service is served by Caddy, which redirects and static responses always are
+func (se *ServiceEntry) Forwarded() bool {
+	return se.Forwarding || se.Response.Type != ""
+}
+
+// Value stores the response as JSON
+func (r StaticResponse) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+// Scan reads a response stored as JSON
+func (r *StaticResponse) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// StatusCode returns the status Caddy answers with
+func (r StaticResponse) StatusCode() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+	if r.Type == ResponseRedirect {
+		if r.Permanent {
+			return 301
+		}
+		return 302
+	}
+	return 200
+}
+
+func (r StaticResponse) validate() []FieldError {
+	errs := make([]FieldError, 0)
+	switch r.Type {
+	case "":
+		return errs
+	case ResponseRedirect:
+		if strings.ContainsAny(r.Location, "\r\n") {
+			errs = append(errs, FieldError{"response.location", "Location cannot contain line breaks"})
+		} else if !strings.HasPrefix(r.Location, "/") {
+			if u, err := url.Parse(r.Location); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, FieldError{"response.location", "Location must be an http(s) URL or a path"})
+			}
+		}
+		if r.Status != 0 && (r.Status < 300 || r.Status > 399) {
+			errs = append(errs, FieldError{"response.status", "Redirect status must be between 300 and 399"})
+		}
+	case ResponseStatic:
+		if r.Status != 0 && (r.Status < 100 || r.Status > 599) {
+			errs = append(errs, FieldError{"response.status", "Status must be between 100 and 599"})
+		}
+	default:
+		errs = append(errs, FieldError{"response.type", "Type must be redirect or static"})
+	}
+	for name, value := range r.Headers {
+		if !isHeaderName(name) {
+			errs = append(errs, FieldError{"response.headers", "Invalid header name " + name})
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, FieldError{"response.headers", "Value of header " + name + " cannot contain line breaks"})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// RouteRule sends matching requests of a forwarded service to their own upstreams
+type RouteRule struct {
+	// Paths may end with * to match a prefix, e.g. /api/*
+	Paths   []string          `json:"paths"`
+	Methods []string          `json:"methods"`
+	Headers map[string]string `json:"headers"`
+	// StripPrefix is removed from the path before the request is proxied
+	StripPrefix string `json:"strip_prefix"`
+	// Rewrite replaces the URI, Caddy placeholders such as {http.request.uri.query} may be used
+	Rewrite   string     `json:"rewrite"`
+	Upstreams []Upstream `json:"upstreams"`
+}
+
+// RouteRules are tried in order before the service's own upstreams
+type RouteRules []RouteRule
+
+// Value stores the rules as JSON
+func (r RouteRules) Value() (driver.Value, error) {
+	if r == nil {
+		r = RouteRules{}
+	}
+	return jsonValue(r)
+}
+
+// Scan reads rules stored as JSON
+func (r *RouteRules) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+var methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}
+
+func (r RouteRules) validate(policy string) []FieldError {
+	errs := make([]FieldError, 0)
+	for i, rule := range r {
+		field := fmt.Sprintf("rules.%d", i)
+		if len(rule.Paths) == 0 && len(rule.Methods) == 0 && len(rule.Headers) == 0 {
+			errs = append(errs, FieldError{field, "Rule needs a path, method or header to match"})
+		}
+		for _, path := range rule.Paths {
+			if !strings.HasPrefix(path, "/") {
+				errs = append(errs, FieldError{field + ".paths", "Path " + path + " must start with /"})
+			}
+		}
+		for _, method := range rule.Methods {
+			known := false
+			for _, m := range methods {
+				known = known || method == m
+			}
+			if !known {
+				errs = append(errs, FieldError{field + ".methods", "Unknown method " + method})
+			}
+		}
+		for name := range rule.Headers {
+			if !isHeaderName(name) {
+				errs = append(errs, FieldError{field + ".headers", "Invalid header name " + name})
+			}
+		}
+		if rule.StripPrefix != "" && !strings.HasPrefix(rule.StripPrefix, "/") {
+			errs = append(errs, FieldError{field + ".strip_prefix", "Prefix must start with /"})
+		}
+		if rule.Rewrite != "" && !strings.HasPrefix(rule.Rewrite, "/") {
+			errs = append(errs, FieldError{field + ".rewrite", "Rewritten URI must start with /"})
+		}
+		if len(rule.Upstreams) == 0 {
+			errs = append(errs, FieldError{field + ".upstreams", "Rule needs at least one upstream"})
+		}
+		errs = append(errs, validateUpstreams(field+".upstreams", rule.Upstreams, policy)...)
+	}
+	return errs
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// FieldError describes why a single field of a request is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// reservedNames are used by the server itself and cannot hold services
+var reservedNames = []string{"_nameserver-verify"}
+
+// Validate checks a service entry before it is created or updated.
+// An empty result means the entry is valid.
+func (se *ServiceEntry) Validate() []FieldError {
+	errs := make([]FieldError, 0)
+	se.Forwarding = se.Forwarded()
+	errs = append(errs, validateSubdomain(se.Subdomain, se.Domain)...)
+
+	// Forwarded services may list their upstreams or not proxy at all
+	balanced := se.Forwarding && (len(se.LoadBalancing.Upstreams) > 0 || se.Response.Type != "")
+	if se.Destination == "" && !balanced {
+		errs = append(errs, FieldError{"destination", "Destination is required"})
+	}
+	if se.RateLimit < 0 {
+		errs = append(errs, FieldError{"rate_limit", "Rate limit cannot be negative"})
+	}
+	if se.LimitBy < LimitBySecond || se.LimitBy > LimitByHour {
+		errs = append(errs, FieldError{"limit_by", "Limit by must be seconds, minutes or hours"})
+	}
+	if se.LimitHeader != "" && !isHeaderName(se.LimitHeader) {
+		errs = append(errs, FieldError{"limit_header", "Invalid header name " + se.LimitHeader})
+	}
+
+	if se.Forwarding {
+		errs = append(errs, se.WAF.validate()...)
+		errs = append(errs, se.LoadBalancing.validate()...)
+		errs = append(errs, se.Rules.validate(se.LoadBalancing.Policy)...)
+		errs = append(errs, se.Response.validate()...)
+		errs = append(errs, se.Headers.validate()...)
+		if balanced {
+			return errs
+		}
+		// Forwarded names always answer with the proxy's addresses so the record type is irrelevant
+		if se.Port < 1 || se.Port > 65535 {
+			errs = append(errs, FieldError{"port", "Port must be between 1 and 65535"})
+		}
+		if se.Destination != "" {
+			host, _ := SplitScheme(se.Destination)
+			if net.ParseIP(host) == nil && !isHostname(host) {
+				errs = append(errs, FieldError{"destination", "Destination must be an IP address or hostname"})
+			}
+		}
+		return errs
+	}
+
+	if se.DNSRecordType == "" {
+		return append(errs, FieldError{"dns_record_type", "Record type is required unless forwarding"})
+	}
+	if se.Destination == "" {
+		return errs
+	}
+	switch se.DNSRecordType {
+	case "A":
+		if ip := net.ParseIP(se.Destination); ip == nil || ip.To4() == nil {
+			errs = append(errs, FieldError{"destination", "A records need an IPv4 address"})
+		}
+	case "AAAA":
+		if ip := net.ParseIP(se.Destination); ip == nil || ip.To4() != nil {
+			errs = append(errs, FieldError{"destination", "AAAA records need an IPv6 address"})
+		}
+	case "CNAME", "NS", "PTR", "ALIAS":
+		if !isHostname(se.Destination) {
+			errs = append(errs, FieldError{"destination", se.DNSRecordType + " records need a fully qualified domain name"})
+		}
+		if se.DNSRecordType == "CNAME" && se.Subdomain == "" {
+			errs = append(errs, FieldError{"dns_record_type", "CNAME is not allowed at the zone apex, use ALIAS instead"})
+		}
+	case "MX":
+		fields := strings.Fields(se.Destination)
+		if len(fields) != 2 {
+			errs = append(errs, FieldError{"destination", "MX records need a preference and a mail server, e.g. \"10 mail.example.com\""})
+			break
+		}
+		if _, err := strconv.ParseUint(fields[0], 10, 16); err != nil {
+			errs = append(errs, FieldError{"destination", "MX preference must be between 0 and 65535"})
+		}
+		if !isHostname(fields[1]) {
+			errs = append(errs, FieldError{"destination", "MX mail server must be a fully qualified domain name"})
+		}
+	default:
+		if _, ok := dns.StringToType[se.DNSRecordType]; !ok {
+			errs = append(errs, FieldError{"dns_record_type", "Unknown record type " + se.DNSRecordType})
+			break
+		}
+		if _, err := dns.NewRR(fmt.Sprintf("x. 60 IN %s %s", se.DNSRecordType, se.Destination)); err != nil {
+			errs = append(errs, FieldError{"destination", "Invalid " + se.DNSRecordType + " record data"})
+		}
+	}
+	return errs
+}
+
+// Check normalizes and validates an entry that did not come through the service API, e.g. an imported record.
+// The problems are joined into one message, which is empty when the entry is valid.
+func (se *ServiceEntry) Check() string {
+	errs := se.Normalize()
+	if len(errs) == 0 {
+		errs = se.Validate()
+	}
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Field+": "+err.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func validateSubdomain(subdomain, domain string) []FieldError {
+	errs := make([]FieldError, 0)
+	if subdomain == "" {
+		return errs
+	}
+	if domain != "" && len(subdomain)+1+len(domain) > 253 {
+		errs = append(errs, FieldError{"subdomain", "Name cannot be longer than 253 characters"})
+	}
+	labels := strings.Split(subdomain, ".")
+	for _, reserved := range reservedNames {
+		if labels[0] == reserved {
+			errs = append(errs, FieldError{"subdomain", reserved + " is reserved"})
+		}
+	}
+	for _, label := range labels {
+		if message := checkLabel(label); message != "" {
+			errs = append(errs, FieldError{"subdomain", message})
+			break
+		}
+	}
+	return errs
+}
+
+// checkLabel applies the hostname rules to a single label, allowing underscores for service names
+func checkLabel(label string) string {
+	if len(label) == 0 {
+		return "Labels cannot be empty"
+	}
+	if len(label) > 63 {
+		return "Labels cannot be longer than 63 characters"
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return "Labels cannot start or end with a hyphen"
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Sprintf("Invalid character %q in label %s", r, label)
+		}
+	}
+	return ""
+}
+
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if checkLabel(label) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderName checks a header name against the token characters of RFC 9110
+func isHeaderName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return name != ""
+}
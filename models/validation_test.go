@@ -0,0 +1,204 @@
+package models
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	upstreams := func(addresses ...string) LoadBalancing {
+		lb := LoadBalancing{}
+		for _, address := range addresses {
+			lb.Upstreams = append(lb.Upstreams, Upstream{Address: address})
+		}
+		return lb
+	}
+	tests := []struct {
+		name   string
+		entry  ServiceEntry
+		fields []string
+	}{
+		{"a", ServiceEntry{Subdomain: "www", DNSRecordType: "A", Destination: "192.0.2.1"}, nil},
+		{"a with ipv6", ServiceEntry{Subdomain: "www", DNSRecordType: "A", Destination: "2001:db8::1"}, []string{"destination"}},
+		{"aaaa", ServiceEntry{DNSRecordType: "AAAA", Destination: "2001:db8::1"}, nil},
+		{"aaaa with ipv4", ServiceEntry{DNSRecordType: "AAAA", Destination: "192.0.2.1"}, []string{"destination"}},
+		{"cname", ServiceEntry{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.net."}, nil},
+		{"cname at apex", ServiceEntry{DNSRecordType: "CNAME", Destination: "example.net."}, []string{"dns_record_type"}},
+		{"alias at apex", ServiceEntry{DNSRecordType: "ALIAS", Destination: "example.net"}, nil},
+		{"ns with address", ServiceEntry{Subdomain: "sub", DNSRecordType: "NS", Destination: "192.0.2.1:53"}, []string{"destination"}},
+		{"mx", ServiceEntry{DNSRecordType: "MX", Destination: "10 mail.example.com."}, nil},
+		{"mx without preference", ServiceEntry{DNSRecordType: "MX", Destination: "mail.example.com"}, []string{"destination"}},
+		{"mx preference out of range", ServiceEntry{DNSRecordType: "MX", Destination: "70000 mail.example.com"}, []string{"destination"}},
+		{"txt", ServiceEntry{DNSRecordType: "TXT", Destination: "\"v=spf1 -all\""}, nil},
+		{"srv", ServiceEntry{Subdomain: "_sip._tcp", DNSRecordType: "SRV", Destination: "10 5 5060 sip.example.com."}, nil},
+		{"srv missing target", ServiceEntry{Subdomain: "_sip._tcp", DNSRecordType: "SRV", Destination: "10 5 5060"}, []string{"destination"}},
+		{"unknown type", ServiceEntry{DNSRecordType: "BOGUS", Destination: "x"}, []string{"dns_record_type"}},
+		{"missing type", ServiceEntry{Destination: "192.0.2.1"}, []string{"dns_record_type"}},
+		{"missing destination", ServiceEntry{DNSRecordType: "A"}, []string{"destination"}},
+		{"reserved name", ServiceEntry{Subdomain: "_nameserver-verify", DNSRecordType: "TXT", Destination: "\"x\""}, []string{"subdomain"}},
+		{"empty label", ServiceEntry{Subdomain: "a..b", DNSRecordType: "A", Destination: "192.0.2.1"}, []string{"subdomain"}},
+		{"hyphen label", ServiceEntry{Subdomain: "-a", DNSRecordType: "A", Destination: "192.0.2.1"}, []string{"subdomain"}},
+		{"negative rate limit", ServiceEntry{DNSRecordType: "A", Destination: "192.0.2.1", RateLimit: -1}, []string{"rate_limit"}},
+		{"limit by out of range", ServiceEntry{DNSRecordType: "A", Destination: "192.0.2.1", LimitBy: 3}, []string{"limit_by"}},
+		{"invalid limit header", ServiceEntry{DNSRecordType: "A", Destination: "192.0.2.1", LimitHeader: "X Key"}, []string{"limit_header"}},
+
+		{"forwarded", ServiceEntry{Subdomain: "www", Destination: "backend.internal", Port: 8080, Forwarding: true}, nil},
+		{"forwarded over https", ServiceEntry{Destination: "https://backend.internal", Port: 443, Forwarding: true}, nil},
+		{"forwarded without port", ServiceEntry{Destination: "backend.internal", Forwarding: true}, []string{"port"}},
+		{"forwarded to an invalid host", ServiceEntry{Destination: "back end", Port: 80, Forwarding: true}, []string{"destination"}},
+		{"upstreams", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("10.0.0.1:8080", "10.0.0.2:8080")}, nil},
+		{"upstreams over tls", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("https://a.internal:8443", "b.internal:443")}, nil},
+		{"upstream without port", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("10.0.0.1")}, []string{"load_balancing.upstreams"}},
+		{"https mixed with plain", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("https://a.internal:8443", "b.internal:8080")}, []string{"load_balancing.upstreams"}},
+		{"port 443 mixed with plain", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("a.internal:443", "b.internal:8080")}, []string{"load_balancing.upstreams"}},
+		{"plain port 443", ServiceEntry{Forwarding: true, LoadBalancing: upstreams("http://a.internal:443", "b.internal:8080")}, nil},
+		{"weights need round robin", ServiceEntry{Forwarding: true, LoadBalancing: LoadBalancing{Policy: "least_conn", Upstreams: []Upstream{{Address: "10.0.0.1:80", Weight: 2}}}}, []string{"load_balancing.upstreams"}},
+		{"unknown policy", ServiceEntry{Forwarding: true, LoadBalancing: LoadBalancing{Policy: "random", Upstreams: []Upstream{{Address: "10.0.0.1:80"}}}}, []string{"load_balancing.policy"}},
+		{"relative health path", ServiceEntry{Forwarding: true, LoadBalancing: LoadBalancing{HealthPath: "health", Upstreams: []Upstream{{Address: "10.0.0.1:80"}}}}, []string{"load_balancing.health_path"}},
+		{"rule", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, Rules: RouteRules{{Paths: []string{"/api/*"}, Upstreams: []Upstream{{Address: "10.0.0.2:80"}}}}}, nil},
+		{"rule without matcher or upstreams", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, Rules: RouteRules{{}}}, []string{"rules.0", "rules.0.upstreams"}},
+		{"rule mixing tls", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, Rules: RouteRules{{Methods: []string{"POST"}, Upstreams: []Upstream{{Address: "a.internal:443"}, {Address: "b.internal:80"}}}}}, []string{"rules.0.upstreams"}},
+		{"waf", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, WAF: WAFSettings{Enabled: true, Mode: WAFBlock, ParanoiaLevel: 1, CustomRules: "SecRule ARGS \"@contains attack\" \"id:1000,deny\""}}, nil},
+		{"waf reading files", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, WAF: WAFSettings{Enabled: true, Mode: WAFBlock, ParanoiaLevel: 1, CustomRules: "SecRule ARGS \"@pmFromFile /etc/passwd\" \"id:1000,deny\""}}, []string{"waf.custom_rules"}},
+		{"waf with continued operator", ServiceEntry{Forwarding: true, Destination: "10.0.0.1", Port: 80, WAF: WAFSettings{Enabled: true, Mode: WAFBlock, ParanoiaLevel: 1, CustomRules: "SecRule ARGS \\\n  \"@ipMatchFromFile ips.txt\" \"id:1000,deny\""}}, []string{"waf.custom_rules"}},
+
+		{"redirect", ServiceEntry{Response: StaticResponse{Type: ResponseRedirect, Location: "https://example.net/"}}, nil},
+		{"redirect to a path", ServiceEntry{Response: StaticResponse{Type: ResponseRedirect, Location: "/new"}}, nil},
+		{"redirect to another scheme", ServiceEntry{Response: StaticResponse{Type: ResponseRedirect, Location: "javascript:alert(1)"}}, []string{"response.location"}},
+		{"redirect with a line break", ServiceEntry{Response: StaticResponse{Type: ResponseRedirect, Location: "/new\r\nSet-Cookie: a=b"}}, []string{"response.location"}},
+		{"redirect status", ServiceEntry{Response: StaticResponse{Type: ResponseRedirect, Location: "/", Status: 200}}, []string{"response.status"}},
+		{"static", ServiceEntry{Response: StaticResponse{Type: ResponseStatic, Body: "ok", Headers: map[string]string{"Content-Type": "text/plain"}}}, nil},
+		{"static header with a line break", ServiceEntry{Response: StaticResponse{Type: ResponseStatic, Headers: map[string]string{"X-A": "a\nX-B: b"}}}, []string{"response.headers"}},
+		{"unknown response", ServiceEntry{Response: StaticResponse{Type: "teapot"}}, []string{"response.type"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.entry.Domain = "example.com"
+			fields := make([]string, 0)
+			seen := make(map[string]bool)
+			for _, err := range test.entry.Validate() {
+				if !seen[err.Field] {
+					fields = append(fields, err.Field)
+				}
+				seen[err.Field] = true
+			}
+			sort.Strings(fields)
+			want := append([]string{}, test.fields...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(fields, want) {
+				t.Errorf("fields = %v, want %v", fields, want)
+			}
+		})
+	}
+}
+
+func TestValidateDerivesForwarding(t *testing.T) {
+	entry := ServiceEntry{Domain: "example.com", Response: StaticResponse{Type: ResponseStatic}}
+	if errs := entry.Validate(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !entry.Forwarding {
+		t.Error("static responses must be stored as forwarded")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ServiceEntry
+		want  ServiceEntry
+	}{
+		{
+			"subdomain",
+			ServiceEntry{Subdomain: "bücher", DNSRecordType: "A", Destination: "192.0.2.1"},
+			ServiceEntry{Subdomain: "xn--bcher-kva", DNSRecordType: "A", Destination: "192.0.2.1"},
+		},
+		{
+			"cname keeps the trailing dot",
+			ServiceEntry{Subdomain: "www", DNSRecordType: "CNAME", Destination: "bücher.example."},
+			ServiceEntry{Subdomain: "www", DNSRecordType: "CNAME", Destination: "xn--bcher-kva.example."},
+		},
+		{
+			"mx exchange",
+			ServiceEntry{DNSRecordType: "MX", Destination: "10 mail.bücher.example"},
+			ServiceEntry{DNSRecordType: "MX", Destination: "10 mail.xn--bcher-kva.example"},
+		},
+		{
+			"ipv6 addresses are canonical",
+			ServiceEntry{DNSRecordType: "AAAA", Destination: "2001:DB8:0:0::0001"},
+			ServiceEntry{DNSRecordType: "AAAA", Destination: "2001:db8::1"},
+		},
+		{
+			"txt is left alone",
+			ServiceEntry{DNSRecordType: "TXT", Destination: "\"bücher\""},
+			ServiceEntry{DNSRecordType: "TXT", Destination: "\"bücher\""},
+		},
+		{
+			"forwarded destination keeps its scheme",
+			ServiceEntry{Destination: "https://bücher.example", Port: 443, Forwarding: true},
+			ServiceEntry{Destination: "https://xn--bcher-kva.example", Port: 443, Forwarding: true},
+		},
+		{
+			"upstreams keep their port and ip addresses",
+			ServiceEntry{Forwarding: true, LoadBalancing: LoadBalancing{Upstreams: []Upstream{{Address: "bücher.example:8080"}, {Address: "[2001:db8::1]:80"}}}},
+			ServiceEntry{Forwarding: true, LoadBalancing: LoadBalancing{Upstreams: []Upstream{{Address: "xn--bcher-kva.example:8080"}, {Address: "[2001:db8::1]:80"}}}},
+		},
+		{
+			"normalize does not enable forwarding",
+			ServiceEntry{Response: StaticResponse{Type: ResponseStatic}},
+			ServiceEntry{Response: StaticResponse{Type: ResponseStatic}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errs := test.entry.Normalize(); len(errs) != 0 {
+				t.Fatal(errs)
+			}
+			if !reflect.DeepEqual(test.entry, test.want) {
+				t.Errorf("entry = %+v, want %+v", test.entry, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePTRRecord(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string
+		err      bool
+	}{
+		{"bücher.example.", "xn--bcher-kva.example.", false},
+		{"Mail.Example.com", "mail.example.com", false},
+		{"", "", true},
+		{"not a host", "", true},
+		{"-bad.example.com", "", true},
+	}
+	for _, test := range tests {
+		record := PTRRecord{Hostname: test.hostname}
+		err := record.Normalize()
+		if (err != nil) != test.err {
+			t.Errorf("Normalize(%q) error = %v", test.hostname, err)
+			continue
+		}
+		if err == nil && record.Hostname != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.hostname, record.Hostname, test.want)
+		}
+	}
+}
+
+func TestUsesTLS(t *testing.T) {
+	tests := map[string]bool{
+		"https://a.internal":      true,
+		"https://a.internal:8443": true,
+		"a.internal:443":          true,
+		"http://a.internal:443":   false,
+		"a.internal:8080":         false,
+		"http://a.internal:8080":  false,
+	}
+	for address, want := range tests {
+		if got := UsesTLS(address); got != want {
+			t.Errorf("UsesTLS(%q) = %v, want %v", address, got, want)
+		}
+	}
+}
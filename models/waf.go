@@ -0,0 +1,98 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	WAFDetect = "detect"
+	WAFBlock  = "block"
+)
+
+// WAFSettings configure the Coraza firewall with the OWASP Core Rule Set in front of a forwarded service
+type WAFSettings struct {
+	Enabled bool `json:"enabled"`
+	// Mode is detect to only log matches or block to reject them
+	Mode          string `json:"mode"`
+	ParanoiaLevel int    `json:"paranoia_level"`
+	// Exclusions are IDs of rules that are removed, e.g. to silence false positives
+	Exclusions  []int  `json:"exclusions"`
+	CustomRules string `json:"custom_rules"`
+}
+
+// Value stores the settings as JSON
+func (w WAFSettings) Value() (driver.Value, error) {
+	return jsonValue(w)
+}
+
+// Scan reads settings stored as JSON, services without any are left disabled
+func (w *WAFSettings) Scan(src interface{}) error {
+	return scanJSON(src, w)
+}
+
+// customDirectives may be used in custom rules. Others such as Include could read files on the proxy.
+var customDirectives = []string{"SecRule", "SecAction", "SecMarker", "SecRuleRemoveById", "SecRuleRemoveByTag", "SecRuleUpdateTargetById"}
+
+// forbiddenOperators read files such as @pmFromFile or run programs on the proxy, and matches are shown to the user
+var forbiddenOperators = regexp.MustCompile(`(?i)@\w*FromFile\b|@inspectFile\b|\bexec\s*:`)
+
+func (w WAFSettings) validate() []FieldError {
+	errs := make([]FieldError, 0)
+	if !w.Enabled {
+		return errs
+	}
+	if w.Mode != WAFDetect && w.Mode != WAFBlock {
+		errs = append(errs, FieldError{"waf.mode", "Mode must be detect or block"})
+	}
+	if w.ParanoiaLevel < 1 || w.ParanoiaLevel > 4 {
+		errs = append(errs, FieldError{"waf.paranoia_level", "Paranoia level must be between 1 and 4"})
+	}
+	for _, id := range w.Exclusions {
+		if id <= 0 {
+			errs = append(errs, FieldError{"waf.exclusions", fmt.Sprintf("Invalid rule ID %d", id)})
+		}
+	}
+	continued := false
+	for _, line := range strings.Split(w.CustomRules, "\n") {
+		line = strings.TrimSpace(line)
+		// Operators and actions may be on continued lines too
+		if operator := forbiddenOperators.FindString(line); operator != "" && !strings.HasPrefix(line, "#") {
+			errs = append(errs, FieldError{"waf.custom_rules", operator + " is not allowed in custom rules"})
+		}
+		// Lines ending with a backslash continue on the next line
+		wasContinued := continued
+		continued = strings.HasSuffix(line, "\\")
+		if wasContinued || line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		directive := strings.Fields(line)[0]
+		allowed := false
+		for _, d := range customDirectives {
+			if strings.EqualFold(directive, d) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			errs = append(errs, FieldError{"waf.custom_rules", "Directive " + directive + " is not allowed in custom rules"})
+		}
+	}
+	return errs
+}
+
+// WAFHit is a rule match logged by the firewall
+type WAFHit struct {
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	URI      string    `json:"uri"`
+	Client   string    `json:"client"`
+	RuleID   string    `json:"rule_id"`
+	Message  string    `json:"message"`
+	Data     string    `json:"data"`
+	Severity string    `json:"severity"`
+	// Blocked is set when the request was denied rather than only logged
+	Blocked bool `json:"blocked"`
+}
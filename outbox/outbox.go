@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/acheong08/nameserver/caddy"
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+)
+
+// maxBackoff caps the delay between retries of a failed operation
+const maxBackoff = 5 * time.Minute
+
+var wake = make(chan struct{}, 1)
+
+// Notify wakes the worker after operations were queued
+func Notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Process applies the queued operations that are due in the order they were made.
+// An operation that failed or is not due yet holds back the later operations of its owner until its retry.
+// A renamed or replaced service removes the old route and adds the new one for another service ID,
+// so the owner rather than the service decides the order, otherwise both routes could serve the host.
+func Process(storage *database.Storage, proxy *caddy.Client) error {
+	operations, err := storage.DB.PendingCaddy()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	blocked := make(map[int]bool)
+	blockedOwners := make(map[string]bool)
+	block := func(operation models.CaddyOperation) {
+		blocked[operation.ServiceID] = true
+		// Operations queued before owners were recorded only hold back their own service
+		if operation.Owner != "" {
+			blockedOwners[operation.Owner] = true
+		}
+	}
+	for _, operation := range operations {
+		if blocked[operation.ServiceID] || blockedOwners[operation.Owner] {
+			continue
+		}
+		if operation.NextAttemptAt.After(now) {
+			block(operation)
+			continue
+		}
+		err := apply(proxy, operation)
+		if err != nil {
+			block(operation)
+			log.Printf("Failed to sync route of service %d: %s\n", operation.ServiceID, err.Error())
+			err = storage.DB.CaddyFailed(operation, err.Error(), now.Add(backoff(operation.Attempts)))
+		} else {
+			err = storage.DB.CaddyApplied(operation)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apply(proxy *caddy.Client, operation models.CaddyOperation) error {
+	// Routes are not changed while the reconciler compares them
+	proxy.Lock()
+	defer proxy.Unlock()
+	if operation.Operation == "remove" {
+		return proxy.Remove(operation.ServiceID)
+	}
+	var config caddy.Config
+	if err := json.Unmarshal([]byte(operation.Config), &config); err != nil {
+		return err
+	}
+	return proxy.Update(config)
+}
+
+func backoff(attempts int) time.Duration {
+	if attempts > 8 {
+		return maxBackoff
+	}
+	delay := time.Second << attempts
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// Watch applies operations as soon as they are queued and retries failed ones every interval
+func Watch(storage *database.Storage, proxy *caddy.Client, interval time.Duration) {
+	for {
+		if err := Process(storage, proxy); err != nil {
+			log.Printf("Failed to process Caddy outbox: %s\n", err.Error())
+		}
+		select {
+		case <-wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// QueueUpdate queues the route of a forwarded service in the transaction of its database change.
+// service.ID and service.Domain must be set.
+func QueueUpdate(storage *database.Storage, tx *sql.Tx, service models.ServiceEntry) error {
+	return storage.DB.QueueCaddy(tx, service.Owner, service.ID, "update", caddy.ServiceConfig(service).JSON())
+}
+
+// QueueRemove queues the removal of the route of a service of owner in the transaction of its database change
+func QueueRemove(storage *database.Storage, tx *sql.Tx, owner string, serviceID int) error {
+	return storage.DB.QueueCaddy(tx, owner, serviceID, "remove", nil)
+}
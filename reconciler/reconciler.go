@@ -0,0 +1,137 @@
+package reconciler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/acheong08/nameserver/caddy"
+	"github.com/acheong08/nameserver/database"
+)
+
+// Report lists the routes repaired by a reconciliation
+type Report struct {
+	Tagged  int      `json:"tagged"`
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// Drifted reports whether Caddy did not match the database
+func (r Report) Drifted() bool {
+	return r.Tagged > 0 || len(r.Added) > 0 || len(r.Updated) > 0 || len(r.Removed) > 0
+}
+
+// Reconcile makes Caddy's routes match the forwarded services in the database.
+// Only routes tagged with a service @id are changed, other routes are left alone.
+// Every repair is recorded as a caddy_drift event of the service's owner,
+// routes without a service are recorded as server events.
+func Reconcile(storage *database.Storage, proxy *caddy.Client) (Report, error) {
+	report := Report{
+		Added:   make([]string, 0),
+		Updated: make([]string, 0),
+		Removed: make([]string, 0),
+	}
+	// The outbox worker must not change routes while they are compared
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	services, err := storage.DB.GetForwardingServices()
+	if err != nil {
+		return report, err
+	}
+	// Services with queued operations are left to the outbox worker
+	pending, err := storage.DB.PendingCaddyServices()
+	if err != nil {
+		return report, err
+	}
+	// A newer forwarded service replaces the route of older ones for the same host
+	hosts := make(map[string]int, len(services))
+	configs := make(map[int]caddy.Config, len(services))
+	owners := make(map[string]string, len(services))
+	for _, service := range services {
+		config := caddy.ServiceConfig(service)
+		hosts[config.Match[0].Host[0]] = service.ID
+		configs[service.ID] = config
+		owners[caddy.RouteID(service.ID)] = service.Owner
+	}
+	desired := make(map[string]caddy.Config, len(hosts))
+	for _, id := range hosts {
+		desired[caddy.RouteID(id)] = configs[id]
+	}
+
+	// Routes created before they were addressed by @id are claimed first
+	report.Tagged, err = proxy.TagRoutes(hosts)
+	if err != nil {
+		return report, err
+	}
+	if report.Tagged > 0 {
+		drift(storage, "", fmt.Sprintf("Tagged %d Caddy routes with their service ID", report.Tagged))
+	}
+
+	routes, err := proxy.Routes()
+	if err != nil {
+		return report, err
+	}
+	live := make(map[string]caddy.Config, len(routes))
+	for _, route := range routes {
+		if caddy.Managed(route.ID) {
+			live[route.ID] = route
+		}
+	}
+
+	for serviceID := range pending {
+		id := caddy.RouteID(serviceID)
+		delete(desired, id)
+		delete(live, id)
+	}
+
+	for id, config := range desired {
+		route, ok := live[id]
+		if !ok {
+			if err := proxy.AddConfig(config); err != nil {
+				return report, err
+			}
+			report.Added = append(report.Added, id)
+			drift(storage, owners[id], fmt.Sprintf("Route %s for %s was missing from Caddy and has been added", id, config.Match[0].Host[0]))
+			continue
+		}
+		// Both sides are rendered through Config so fields we do not manage are ignored
+		if !bytes.Equal(route.JSON(), config.JSON()) {
+			if err := proxy.Update(config); err != nil {
+				return report, err
+			}
+			report.Updated = append(report.Updated, id)
+			drift(storage, owners[id], fmt.Sprintf("Route %s for %s differed from the database and has been updated", id, config.Match[0].Host[0]))
+		}
+	}
+	for id := range live {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		if err := proxy.RemoveID(id); err != nil {
+			return report, err
+		}
+		report.Removed = append(report.Removed, id)
+		drift(storage, "", fmt.Sprintf("Route %s has no forwarded service and has been removed", id))
+	}
+	return report, nil
+}
+
+func drift(storage *database.Storage, owner, message string) {
+	log.Println(message)
+	if err := storage.DB.NewEvent(owner, "caddy_drift", message); err != nil {
+		log.Printf("Failed to record event: %s\n", err.Error())
+	}
+}
+
+// Watch reconciles on startup and then periodically
+func Watch(storage *database.Storage, proxy *caddy.Client, interval time.Duration) {
+	for {
+		if _, err := Reconcile(storage, proxy); err != nil {
+			log.Printf("Failed to reconcile Caddy routes: %s\n", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
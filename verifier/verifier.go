@@ -0,0 +1,101 @@
+package verifier
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+// RecordName is where users publish their verification token as a TXT record
+func RecordName(domain string) string {
+	return "_nameserver-verify." + domain
+}
+
+// Check looks up the verification TXT record and the NS records of the user's domain.
+// The domain is verified if the token is published or the domain is delegated to our nameservers.
+// Delegation is shared by every account claiming the domain, so it only counts for a sole claimant.
+func Check(storage *database.Storage, user models.User) (bool, error) {
+	txts, err := lookup(storage.Upstream, RecordName(user.Domain), dns.TypeTXT)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range txts {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == user.VerificationToken {
+			return true, nil
+		}
+	}
+	if len(storage.Nameservers) == 0 {
+		return false, nil
+	}
+	claims, err := storage.DB.DomainClaims(user.Domain)
+	if err != nil || claims != 1 {
+		return false, err
+	}
+	nss, err := lookup(storage.Upstream, user.Domain, dns.TypeNS)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range nss {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		for _, ours := range storage.Nameservers {
+			if strings.EqualFold(dns.Fqdn(ours), ns.Ns) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func lookup(upstream, name string, qType uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qType)
+	m.RecursionDesired = true
+	r, _, err := new(dns.Client).Exchange(m, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("Upstream returned %s for %s", dns.RcodeToString[r.Rcode], name)
+	}
+	return r.Answer, nil
+}
+
+// Verify checks a user and activates their zone once ownership is proven
+func Verify(storage *database.Storage, user models.User) (bool, error) {
+	ok, err := Check(storage, user)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := storage.DB.VerifyUser(user.Username); err != nil {
+		return false, err
+	}
+	storage.Cache.Clear()
+	if err := storage.DB.NewEvent(user.Username, "verification", fmt.Sprintf("Domain %s verified for %s", user.Domain, user.Username)); err != nil {
+		log.Printf("Failed to record event: %s\n", err.Error())
+	}
+	return true, nil
+}
+
+// Watch periodically verifies every pending domain
+func Watch(storage *database.Storage, interval time.Duration) {
+	for {
+		users, err := storage.DB.GetUnverifiedUsers()
+		if err != nil {
+			log.Printf("Failed to get unverified users: %s\n", err.Error())
+		}
+		for _, user := range users {
+			if _, err := Verify(storage, user); err != nil {
+				log.Printf("Failed to verify %s: %s\n", user.Domain, err.Error())
+			}
+		}
+		time.Sleep(interval)
+	}
+}
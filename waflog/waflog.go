@@ -0,0 +1,121 @@
+package waflog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+// tailSize is how much of the end of the log is searched for recent hits
+const tailSize = 4 << 20
+
+// field matches the [name "value"] pairs of a Coraza error log
+var field = regexp.MustCompile(`\[(\w+) "((?:[^"\\]|\\.)*)"\]`)
+
+type entry struct {
+	Logger string          `json:"logger"`
+	TS     json.RawMessage `json:"ts"`
+	Msg    string          `json:"msg"`
+}
+
+// Parse reads Caddy's JSON logs and returns the firewall matches in the order they were logged.
+// Lines that are not firewall matches are skipped.
+func Parse(r io.Reader) ([]models.WAFHit, error) {
+	hits := make([]models.WAFHit, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !strings.Contains(e.Msg, "Coraza:") {
+			continue
+		}
+		hit := models.WAFHit{
+			Time:    parseTime(e.TS),
+			Blocked: strings.Contains(e.Msg, "Access denied"),
+		}
+		for _, match := range field.FindAllStringSubmatch(e.Msg, -1) {
+			value := strings.ReplaceAll(match[2], `\"`, `"`)
+			switch match[1] {
+			case "client":
+				hit.Client = value
+			case "id":
+				hit.RuleID = value
+			case "msg":
+				hit.Message = value
+			case "data":
+				hit.Data = value
+			case "severity":
+				hit.Severity = value
+			case "hostname":
+				hit.Host = value
+			case "uri":
+				hit.URI = value
+			}
+		}
+		hits = append(hits, hit)
+	}
+	return hits, scanner.Err()
+}
+
+// parseTime reads Caddy's default unix timestamps as well as formatted ones
+func parseTime(ts json.RawMessage) time.Time {
+	var seconds float64
+	if err := json.Unmarshal(ts, &seconds); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+	}
+	var formatted string
+	if err := json.Unmarshal(ts, &formatted); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, formatted); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Recent returns up to limit of the newest hits for hosts accepted by allow, newest first
+func Recent(path string, allow func(host string) bool, limit int) ([]models.WAFHit, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader = file
+	if info.Size() > tailSize {
+		if _, err := file.Seek(-tailSize, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		// The first line is most likely cut in half
+		buffered := bufio.NewReader(file)
+		buffered.ReadString('\n')
+		reader = buffered
+	}
+	hits, err := Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	recent := make([]models.WAFHit, 0)
+	for i := len(hits) - 1; i >= 0 && len(recent) < limit; i-- {
+		host := hits[i].Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if allow(strings.ToLower(host)) {
+			recent = append(recent, hits[i])
+		}
+	}
+	return recent, nil
+}
@@ -0,0 +1,114 @@
+package waflog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+const (
+	deniedLine = `{"level":"error","logger":"http.handlers.waf","ts":1700000000.5,"msg":"[client \"192.0.2.9\"] Coraza: Access denied (phase 2). [id \"942100\"] [msg \"SQL Injection Attack Detected via libinjection\"] [data \"Matched Data: s&1c found\"] [severity \"critical\"] [hostname \"www.example.com\"] [uri \"/?id=1' or 1=1\"]"}`
+	loggedLine = `{"level":"warn","logger":"http.handlers.waf","ts":"2023-11-14T22:13:20Z","msg":"[client \"198.51.100.7\"] Coraza: Warning. [id \"920350\"] [msg \"Host header is a numeric IP address\"] [data \"a \\\"quoted\\\" value\"] [severity \"warning\"] [hostname \"api.example.com:8443\"] [uri \"/\"]"}`
+	accessLine = `{"level":"info","logger":"http.log.access","ts":1700000001,"msg":"handled request"}`
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		hits []models.WAFHit
+	}{
+		{
+			name: "denied",
+			log:  deniedLine,
+			hits: []models.WAFHit{{
+				Time:     time.Unix(1700000000, 500000000).UTC(),
+				Host:     "www.example.com",
+				URI:      "/?id=1' or 1=1",
+				Client:   "192.0.2.9",
+				RuleID:   "942100",
+				Message:  "SQL Injection Attack Detected via libinjection",
+				Data:     "Matched Data: s&1c found",
+				Severity: "critical",
+				Blocked:  true,
+			}},
+		},
+		{
+			name: "logged with formatted time and escaped quotes",
+			log:  loggedLine,
+			hits: []models.WAFHit{{
+				Time:     time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+				Host:     "api.example.com:8443",
+				URI:      "/",
+				Client:   "198.51.100.7",
+				RuleID:   "920350",
+				Message:  "Host header is a numeric IP address",
+				Data:     `a "quoted" value`,
+				Severity: "warning",
+			}},
+		},
+		{
+			name: "other lines are skipped",
+			log:  accessLine + "\nnot json\n\n",
+			hits: []models.WAFHit{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits, err := Parse(strings.NewReader(test.log))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != len(test.hits) {
+				t.Fatalf("hits = %+v, want %+v", hits, test.hits)
+			}
+			for i := range hits {
+				if !hits[i].Time.Equal(test.hits[i].Time) {
+					t.Errorf("time = %s, want %s", hits[i].Time, test.hits[i].Time)
+				}
+				hits[i].Time = test.hits[i].Time
+				if hits[i] != test.hits[i] {
+					t.Errorf("hit = %+v, want %+v", hits[i], test.hits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRecent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "caddy.log")
+	log := strings.Join([]string{deniedLine, accessLine, loggedLine, deniedLine}, "\n")
+	if err := os.WriteFile(path, []byte(log), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		allow map[string]bool
+		limit int
+		hits  []string
+	}{
+		{"newest first", map[string]bool{"www.example.com": true, "api.example.com": true}, 10, []string{"942100", "920350", "942100"}},
+		{"limit", map[string]bool{"www.example.com": true, "api.example.com": true}, 2, []string{"942100", "920350"}},
+		{"port is ignored", map[string]bool{"api.example.com": true}, 10, []string{"920350"}},
+		{"exact hosts only", map[string]bool{"example.com": true}, 10, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hits, err := Recent(path, func(host string) bool { return test.allow[host] }, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0)
+			for _, hit := range hits {
+				ids = append(ids, hit.RuleID)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.hits, ",") {
+				t.Errorf("hits = %v, want %v", ids, test.hits)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package zonefile
+
+import (
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+)
+
+// FromStorage builds the zone of a user from the stored services.
+// Forwarded services are rendered as A/AAAA records pointing at the reverse proxy.
+func FromStorage(storage *database.Storage, user models.User) (Zone, error) {
+	services, err := storage.DB.GetAllServices(user.Username)
+	if err != nil {
+		return Zone{}, err
+	}
+	settings, err := storage.ZoneSettings(user)
+	if err != nil {
+		return Zone{}, err
+	}
+	zone := Zone{
+		Domain:      user.Domain,
+		Nameservers: settings.Nameservers,
+		PrimaryNS:   settings.PrimaryNS,
+		Hostmaster:  database.HostmasterMbox(settings.Hostmaster),
+		Serial:      settings.Serial,
+		TTL:         settings.DefaultTTL,
+		Refresh:     settings.Refresh,
+		Retry:       settings.Retry,
+		Expire:      settings.Expire,
+		Minimum:     settings.Minimum,
+		Records:     make([]models.ServiceEntry, 0, len(services)),
+	}
+	publicIPv4, publicIPv6 := storage.PublicIPs()
+	forwarded := make(map[string]bool)
+	for _, service := range services {
+		if !service.Forwarding {
+			zone.Records = append(zone.Records, service)
+			continue
+		}
+		if forwarded[service.Subdomain] {
+			continue
+		}
+		forwarded[service.Subdomain] = true
+		for _, ip := range publicIPv4 {
+			zone.Records = append(zone.Records, models.ServiceEntry{Subdomain: service.Subdomain, DNSRecordType: "A", Destination: ip})
+		}
+		for _, ip := range publicIPv6 {
+			zone.Records = append(zone.Records, models.ServiceEntry{Subdomain: service.Subdomain, DNSRecordType: "AAAA", Destination: ip})
+		}
+	}
+	return zone, nil
+}
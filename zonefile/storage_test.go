@@ -0,0 +1,79 @@
+package zonefile
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/acheong08/nameserver/database"
+	"github.com/acheong08/nameserver/models"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := database.NewStorage([]string{"192.0.2.1"}, []string{"2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storage.DB.Close()
+		os.Chdir(wd)
+	})
+	user := models.User{Username: "alice", Password: "secret", Domain: "example.com"}
+	if err := storage.DB.NewUser(user); err != nil {
+		t.Fatal(err)
+	}
+	services := []models.ServiceEntry{
+		{Subdomain: "", DNSRecordType: "ALIAS", Destination: "apex.example.net."},
+		{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+		{Subdomain: "", DNSRecordType: "TXT", Destination: "\"v=spf1 -all\""},
+		{Subdomain: "mail", DNSRecordType: "A", Destination: "192.0.2.10"},
+		{Subdomain: "docs", DNSRecordType: "CNAME", Destination: "example.net."},
+		{Subdomain: "sub", DNSRecordType: "NS", Destination: "ns.example.net."},
+		{Subdomain: "www", Destination: "10.0.0.1", Port: 8080, Forwarding: true},
+		{Subdomain: "old", Forwarding: true, Response: models.StaticResponse{Type: models.ResponseRedirect, Location: "https://example.com"}},
+	}
+	for _, service := range services {
+		service.Owner = user.Username
+		tx, _, err := storage.DB.NewService(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zone, err := FromStorage(storage, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if err := Render(&exported, zone); err != nil {
+		t.Fatal(err)
+	}
+	records, skipped, err := Parse(bytes.NewReader(exported.Bytes()), user.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("parse skipped %v", skipped)
+	}
+	diff, err := storage.DiffZone(user.Username, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Add) != 0 || len(diff.Remove) != 0 {
+		t.Errorf("importing the export changes the zone: add %+v, remove %+v\n%s", diff.Add, diff.Remove, exported.String())
+	}
+	// Both forwarded names are exported with an A and an AAAA record pointing at the proxy
+	if len(diff.Skipped) != 4 {
+		t.Errorf("skipped = %v, want the 4 proxy records", diff.Skipped)
+	}
+}
@@ -0,0 +1,178 @@
+package zonefile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/acheong08/nameserver/models"
+	"github.com/miekg/dns"
+)
+
+// Parse reads a BIND format zone file into service entries for domain.
+// Records that cannot be stored as services are returned as skipped with the reason.
+func Parse(r io.Reader, domain string) ([]models.ServiceEntry, []string, error) {
+	origin := dns.Fqdn(strings.ToLower(domain))
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	parser := dns.NewZoneParser(bytes.NewReader(data), origin, "")
+	parser.SetIncludeAllowed(false)
+
+	entries := make([]models.ServiceEntry, 0)
+	skipped := make([]string, 0)
+	// ALIAS records are exported as comments and read back from them
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// The file is already in memory, so allow lines as long as the whole file
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		if entry, ok := parseAlias(scanner.Text(), origin); ok {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		if header.Class != dns.ClassINET {
+			skipped = append(skipped, fmt.Sprintf("%s: unsupported class %s", rr.String(), dns.ClassToString[header.Class]))
+			continue
+		}
+		if !dns.IsSubDomain(origin, name) {
+			skipped = append(skipped, fmt.Sprintf("%s: outside of zone %s", rr.String(), origin))
+			continue
+		}
+		subdomain := strings.TrimSuffix(strings.TrimSuffix(name, origin), ".")
+		switch header.Rrtype {
+		case dns.TypeSOA:
+			// SOA is synthesized by the server
+			continue
+		case dns.TypeNS:
+			if subdomain == "" {
+				// Apex NS records are always this server
+				continue
+			}
+		}
+		entries = append(entries, models.ServiceEntry{
+			Subdomain:     subdomain,
+			DNSRecordType: dns.TypeToString[header.Rrtype],
+			Destination:   Rdata(rr),
+		})
+	}
+	if err := parser.Err(); err != nil {
+		return nil, nil, err
+	}
+	return entries, skipped, nil
+}
+
+// parseAlias reads a comment written by Render for an ALIAS record, e.g. "; www.example.com. 3600 IN ALIAS target.example.net."
+func parseAlias(line, origin string) (models.ServiceEntry, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, ";") {
+		return models.ServiceEntry{}, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, ";"))
+	if len(fields) != 5 || !strings.EqualFold(fields[2], "IN") || !strings.EqualFold(fields[3], "ALIAS") {
+		return models.ServiceEntry{}, false
+	}
+	if _, err := strconv.ParseUint(fields[1], 10, 32); err != nil {
+		return models.ServiceEntry{}, false
+	}
+	name := strings.ToLower(fields[0])
+	switch {
+	case name == "@":
+		name = origin
+	case !strings.HasSuffix(name, "."):
+		name += "." + origin
+	}
+	if !dns.IsSubDomain(origin, name) {
+		return models.ServiceEntry{}, false
+	}
+	return models.ServiceEntry{
+		Subdomain:     strings.TrimSuffix(strings.TrimSuffix(name, origin), "."),
+		DNSRecordType: "ALIAS",
+		Destination:   fields[4],
+	}, true
+}
+
+// Rdata returns the presentation format of a record without its header
+func Rdata(rr dns.RR) string {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// Zone holds everything needed to render a zone file
+type Zone struct {
+	Domain      string
+	Nameservers []string
+	PrimaryNS   string
+	// Hostmaster is the SOA mailbox name, e.g. hostmaster.example.com
+	Hostmaster string
+	Serial     uint32
+	TTL        uint32
+	Refresh    uint32
+	Retry      uint32
+	Expire     uint32
+	Minimum    uint32
+	Records    []models.ServiceEntry
+}
+
+// Render writes the zone in RFC 1035 format including the synthesized SOA and NS records
+func Render(w io.Writer, zone Zone) error {
+	origin := dns.Fqdn(zone.Domain)
+	if len(zone.Nameservers) == 0 {
+		return fmt.Errorf("At least one nameserver is required")
+	}
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", origin, zone.TTL); err != nil {
+		return err
+	}
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zone.TTL},
+		Ns:      dns.Fqdn(zone.PrimaryNS),
+		Mbox:    dns.Fqdn(zone.Hostmaster),
+		Serial:  zone.Serial,
+		Refresh: zone.Refresh,
+		Retry:   zone.Retry,
+		Expire:  zone.Expire,
+		Minttl:  zone.Minimum,
+	}
+	rrs := []dns.RR{soa}
+	for _, ns := range zone.Nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zone.TTL},
+			Ns:  dns.Fqdn(ns),
+		})
+	}
+	for _, record := range zone.Records {
+		name := origin
+		if record.Subdomain != "" {
+			name = record.Subdomain + "." + origin
+		}
+		if record.DNSRecordType == "ALIAS" {
+			// ALIAS is not a standard type so it is kept as a comment
+			if _, err := fmt.Fprintf(w, "; %s %d IN ALIAS %s\n", name, zone.TTL, record.Destination); err != nil {
+				return err
+			}
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, zone.TTL, record.DNSRecordType, record.Destination))
+		if err != nil {
+			if _, err := fmt.Fprintf(w, "; invalid record %s %s %s\n", name, record.DNSRecordType, record.Destination); err != nil {
+				return err
+			}
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	for _, rr := range rrs {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package zonefile
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/acheong08/nameserver/models"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		zone    string
+		entries []models.ServiceEntry
+		skipped int
+		err     bool
+	}{
+		{
+			name: "records",
+			zone: "$ORIGIN example.com.\n@ 3600 IN A 192.0.2.1\nwww 3600 IN CNAME example.com.\n@ 3600 IN MX 10 mail.example.com.\n",
+			entries: []models.ServiceEntry{
+				{Subdomain: "", DNSRecordType: "A", Destination: "192.0.2.1"},
+				{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.com."},
+				{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+			},
+		},
+		{
+			name: "soa and apex ns are synthesized",
+			zone: "example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600\nexample.com. 3600 IN NS ns1.example.com.\nsub.example.com. 3600 IN NS ns.other.net.\n",
+			entries: []models.ServiceEntry{
+				{Subdomain: "sub", DNSRecordType: "NS", Destination: "ns.other.net."},
+			},
+		},
+		{
+			name:    "names are lowercased",
+			zone:    "WWW.Example.COM. 60 IN AAAA 2001:db8::1\n",
+			entries: []models.ServiceEntry{{Subdomain: "www", DNSRecordType: "AAAA", Destination: "2001:db8::1"}},
+		},
+		{
+			name:    "outside of zone",
+			zone:    "example.net. 60 IN A 192.0.2.1\n",
+			entries: []models.ServiceEntry{},
+			skipped: 1,
+		},
+		{
+			name:    "other class",
+			zone:    "example.com. 60 CH TXT \"chaos\"\n",
+			entries: []models.ServiceEntry{},
+			skipped: 1,
+		},
+		{
+			name: "alias comment",
+			zone: "; www.example.com. 3600 IN ALIAS target.example.net.\n; @ 3600 IN ALIAS apex.example.net.\n; not an alias record\n",
+			entries: []models.ServiceEntry{
+				{Subdomain: "www", DNSRecordType: "ALIAS", Destination: "target.example.net."},
+				{Subdomain: "", DNSRecordType: "ALIAS", Destination: "apex.example.net."},
+			},
+		},
+		{
+			name:    "alias comment after a long line",
+			zone:    "; " + strings.Repeat("x", 100*1024) + "\n; www.example.com. 3600 IN ALIAS target.example.net.\n",
+			entries: []models.ServiceEntry{{Subdomain: "www", DNSRecordType: "ALIAS", Destination: "target.example.net."}},
+		},
+		{
+			name: "alias comment outside of zone",
+			zone: "; www.example.net. 3600 IN ALIAS target.example.net.\n",
+		},
+		{
+			name: "syntax error",
+			zone: "example.com. 60 IN A not-an-address\n",
+			err:  true,
+		},
+		{
+			name: "includes are refused",
+			zone: "$INCLUDE /etc/passwd\n",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, skipped, err := Parse(strings.NewReader(test.zone), "example.com")
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.entries) || (len(entries) > 0 && !reflect.DeepEqual(entries, test.entries)) {
+				t.Errorf("entries = %+v, want %+v", entries, test.entries)
+			}
+			if len(skipped) != test.skipped {
+				t.Errorf("skipped = %v, want %d", skipped, test.skipped)
+			}
+		})
+	}
+}
+
+func TestRenderRoundTrip(t *testing.T) {
+	records := []models.ServiceEntry{
+		{Subdomain: "", DNSRecordType: "A", Destination: "192.0.2.1"},
+		{Subdomain: "", DNSRecordType: "ALIAS", Destination: "target.example.net."},
+		{Subdomain: "www", DNSRecordType: "CNAME", Destination: "example.com."},
+		{Subdomain: "", DNSRecordType: "MX", Destination: "10 mail.example.com."},
+		{Subdomain: "", DNSRecordType: "TXT", Destination: "\"v=spf1 -all\""},
+		{Subdomain: "mail", DNSRecordType: "ALIAS", Destination: "mx.example.net."},
+		{Subdomain: "_sip._tcp", DNSRecordType: "SRV", Destination: "10 5 5060 sip.example.com."},
+	}
+	zone := Zone{
+		Domain:      "example.com",
+		Nameservers: []string{"ns1.example.com", "ns2.example.com"},
+		PrimaryNS:   "ns1.example.com",
+		Hostmaster:  "hostmaster.example.com",
+		Serial:      1,
+		TTL:         3600,
+		Refresh:     7200,
+		Retry:       3600,
+		Expire:      1209600,
+		Minimum:     3600,
+		Records:     records,
+	}
+	var buf bytes.Buffer
+	if err := Render(&buf, zone); err != nil {
+		t.Fatal(err)
+	}
+	entries, skipped, err := Parse(&buf, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("skipped = %v", skipped)
+	}
+	if len(entries) != len(records) {
+		t.Fatalf("parsed %d records, want %d: %+v", len(entries), len(records), entries)
+	}
+	for _, record := range records {
+		found := false
+		for _, entry := range entries {
+			if reflect.DeepEqual(entry, record) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%+v did not survive the round trip: %+v", record, entries)
+		}
+	}
+}
+
+func TestRenderInvalidRecord(t *testing.T) {
+	var buf bytes.Buffer
+	err := Render(&buf, Zone{
+		Domain:      "example.com",
+		Nameservers: []string{"ns1.example.com"},
+		Records:     []models.ServiceEntry{{Subdomain: "www", DNSRecordType: "A", Destination: "not-an-address"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "; invalid record www.example.com. A not-an-address") {
+		t.Errorf("invalid record not commented out:\n%s", buf.String())
+	}
+	if err := Render(&buf, Zone{Domain: "example.com"}); err == nil {
+		t.Error("expected an error without nameservers")
+	}
+}